@@ -29,6 +29,81 @@ type ConfigExtractionRuleSpec struct {
 	Paths []string `json:"paths"`
 }
 
+// ConfigValueSource is a value that can be specified inline, or read from an
+// environment variable or a file.
+type ConfigValueSource struct {
+	// Value is the literal value.
+	Value string `json:"value,omitempty"`
+	// Env is the name of an environment variable to read the value from.
+	Env string `json:"env,omitempty"`
+	// File is the path to a file to read the value from. Relative paths are
+	// resolved relative to the config file.
+	File string `json:"file,omitempty"`
+}
+
+type ConfigRegistryAuthSpec struct {
+	// Username is the username for basic authentication.
+	Username *ConfigValueSource `json:"username,omitempty"`
+	// Password is the password for basic authentication.
+	Password *ConfigValueSource `json:"password,omitempty"`
+	// Token is a bearer token to send to the registry.
+	Token *ConfigValueSource `json:"token,omitempty"`
+}
+
+type ConfigRegistrySpec struct {
+	// Host is the registry host (and optional port) the settings apply to.
+	// Eg. "registry.example.com:5000".
+	Host string `json:"host"`
+	// Insecure allows connecting to the registry over plain HTTP, or over
+	// HTTPS without verifying the server certificate.
+	Insecure bool `json:"insecure,omitempty"`
+	// CAFile is the path to a PEM encoded CA bundle used to verify the
+	// registry's certificate. Relative paths (here and below) are resolved
+	// relative to the config file.
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile is the path to a PEM encoded client certificate.
+	CertFile string `json:"certFile,omitempty"`
+	// KeyFile is the path to the PEM encoded private key for the client certificate.
+	KeyFile string `json:"keyFile,omitempty"`
+	// DockerConfig is the path to a directory containing a Docker config.json
+	// to read credentials from (instead of the default keychain).
+	DockerConfig string `json:"dockerConfig,omitempty"`
+	// Auth is a set of static credentials to use for the registry.
+	// Takes precedence over DockerConfig.
+	Auth *ConfigRegistryAuthSpec `json:"auth,omitempty"`
+}
+
+type ConfigArtifactFileSpec struct {
+	// Path is the path to a file or directory. Directories are stored as
+	// gzipped tar archives. Relative paths are resolved relative to the config file.
+	Path string `json:"path"`
+	// MediaType is the media type of the file.
+	// Defaults to "application/vnd.oci.image.layer.v1.tar".
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+type ConfigArtifactSpec struct {
+	// Name is the reference name of the artifact, eg. "tools/kubectl:v1.30.0"
+	// for oci://<registry>/tools/kubectl:v1.30.0.
+	Name string `json:"name"`
+	// ArtifactType is the type of the artifact.
+	// Defaults to "application/vnd.unknown.artifact.v1".
+	ArtifactType string `json:"artifactType,omitempty"`
+	// Files is a list of files and directories to include in the artifact.
+	Files []ConfigArtifactFileSpec `json:"files"`
+	// Annotations is a set of annotations to add to the artifact manifest.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ConfigChartSpec struct {
+	// Path is the path to a chart directory, or a packaged chart (.tgz).
+	// Relative paths are resolved relative to the config file.
+	Path string `json:"path"`
+	// Repository is the repository to store the chart in, eg. "charts" for
+	// oci://<registry>/charts/<name>. Defaults to "charts".
+	Repository string `json:"repository,omitempty"`
+}
+
 type ConfigSpec struct {
 	// Rules is a list of custom image extraction rules to apply to the manifests.
 	Rules []ConfigExtractionRuleSpec `json:"rules,omitempty"`
@@ -36,6 +111,12 @@ type ConfigSpec struct {
 	// This is useful for images that are not directly referenced in the manifests.
 	// Eg. those that are created by operators.
 	Images []string `json:"images,omitempty"`
+	// Registries is a list of per-registry connection settings.
+	Registries []ConfigRegistrySpec `json:"registries,omitempty"`
+	// Charts is a list of Helm charts to include in the archive (as OCI artifacts).
+	Charts []ConfigChartSpec `json:"charts,omitempty"`
+	// Artifacts is a list of files to include in the archive (as OCI artifacts).
+	Artifacts []ConfigArtifactSpec `json:"artifacts,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type ImageLockEntry struct {
+	// Image is the fully qualified image reference, eg.
+	// "index.docker.io/library/nginx:1.25".
+	Image string `json:"image"`
+	// Digest is the digest of the manifest (or index) the reference resolved to.
+	Digest string `json:"digest"`
+}
+
+type ImageLockSpec struct {
+	// Images is the list of locked images, ordered by reference.
+	Images []ImageLockEntry `json:"images"`
+}
+
+// +kubebuilder:object:root=true
+type ImageLock struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ImageLockSpec `json:"spec"`
+}
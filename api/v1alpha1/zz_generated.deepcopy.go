@@ -52,6 +52,63 @@ func (in *Config) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigArtifactFileSpec) DeepCopyInto(out *ConfigArtifactFileSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigArtifactFileSpec.
+func (in *ConfigArtifactFileSpec) DeepCopy() *ConfigArtifactFileSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigArtifactFileSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigArtifactSpec) DeepCopyInto(out *ConfigArtifactSpec) {
+	*out = *in
+	if in.Files != nil {
+		in, out := &in.Files, &out.Files
+		*out = make([]ConfigArtifactFileSpec, len(*in))
+		copy(*out, *in)
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigArtifactSpec.
+func (in *ConfigArtifactSpec) DeepCopy() *ConfigArtifactSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigArtifactSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigChartSpec) DeepCopyInto(out *ConfigChartSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigChartSpec.
+func (in *ConfigChartSpec) DeepCopy() *ConfigChartSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigChartSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ConfigExtractionRuleSpec) DeepCopyInto(out *ConfigExtractionRuleSpec) {
 	*out = *in
@@ -105,6 +162,56 @@ func (in *ConfigList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigRegistryAuthSpec) DeepCopyInto(out *ConfigRegistryAuthSpec) {
+	*out = *in
+	if in.Username != nil {
+		in, out := &in.Username, &out.Username
+		*out = new(ConfigValueSource)
+		**out = **in
+	}
+	if in.Password != nil {
+		in, out := &in.Password, &out.Password
+		*out = new(ConfigValueSource)
+		**out = **in
+	}
+	if in.Token != nil {
+		in, out := &in.Token, &out.Token
+		*out = new(ConfigValueSource)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigRegistryAuthSpec.
+func (in *ConfigRegistryAuthSpec) DeepCopy() *ConfigRegistryAuthSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigRegistryAuthSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigRegistrySpec) DeepCopyInto(out *ConfigRegistrySpec) {
+	*out = *in
+	if in.Auth != nil {
+		in, out := &in.Auth, &out.Auth
+		*out = new(ConfigRegistryAuthSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigRegistrySpec.
+func (in *ConfigRegistrySpec) DeepCopy() *ConfigRegistrySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigRegistrySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ConfigSpec) DeepCopyInto(out *ConfigSpec) {
 	*out = *in
@@ -120,6 +227,25 @@ func (in *ConfigSpec) DeepCopyInto(out *ConfigSpec) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.Registries != nil {
+		in, out := &in.Registries, &out.Registries
+		*out = make([]ConfigRegistrySpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Charts != nil {
+		in, out := &in.Charts, &out.Charts
+		*out = make([]ConfigChartSpec, len(*in))
+		copy(*out, *in)
+	}
+	if in.Artifacts != nil {
+		in, out := &in.Artifacts, &out.Artifacts
+		*out = make([]ConfigArtifactSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigSpec.
@@ -131,3 +257,79 @@ func (in *ConfigSpec) DeepCopy() *ConfigSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigValueSource) DeepCopyInto(out *ConfigValueSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigValueSource.
+func (in *ConfigValueSource) DeepCopy() *ConfigValueSource {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigValueSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageLock) DeepCopyInto(out *ImageLock) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageLock.
+func (in *ImageLock) DeepCopy() *ImageLock {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageLock)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImageLock) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageLockEntry) DeepCopyInto(out *ImageLockEntry) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageLockEntry.
+func (in *ImageLockEntry) DeepCopy() *ImageLockEntry {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageLockEntry)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageLockSpec) DeepCopyInto(out *ImageLockSpec) {
+	*out = *in
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]ImageLockEntry, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageLockSpec.
+func (in *ImageLockSpec) DeepCopy() *ImageLockSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageLockSpec)
+	in.DeepCopyInto(out)
+	return out
+}
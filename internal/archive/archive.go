@@ -20,93 +20,420 @@ package archive
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 
-	"github.com/dpeckett/archivefs/tarfs"
-	"github.com/dpeckett/uncompr"
-	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/dpeckett/airgapify/internal/artifact"
+	"github.com/dpeckett/airgapify/internal/compression"
+	"github.com/dpeckett/airgapify/internal/progress"
+	"github.com/dpeckett/airgapify/internal/registry"
+	"github.com/dpeckett/airgapify/internal/volume"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/empty"
-	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"k8s.io/apimachinery/pkg/util/sets"
 )
 
-// Create creates an OCI image archive from a set of image references.
-func Create(ctx context.Context, outputPath string, images sets.String, platform *v1.Platform) error {
-	ociLayoutDir, err := os.MkdirTemp("", "airgapify-archive-*")
-	if err != nil {
-		return fmt.Errorf("failed to create temporary archive directory: %w", err)
+const (
+	// AnnotationRefName is the OCI annotation containing the reference name of an image.
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+	// AnnotationBaseDigest is the index annotation recording the digest of the
+	// base archive (the digest of its index.json) an incremental archive was
+	// created against.
+	AnnotationBaseDigest = "tt.pecke.airgapify.base.digest"
+	// AnnotationCompression is the index annotation recording the compression
+	// algorithm (and level) an archive was created with.
+	AnnotationCompression = "tt.pecke.airgapify.compression"
+)
+
+// Format is the output format of an image archive.
+type Format string
+
+const (
+	// FormatOCI is a tar archive containing an OCI image layout.
+	FormatOCI Format = "oci"
+	// FormatOCIDir is an OCI image layout directory (not archived). If the
+	// directory already contains a layout, images are added to it.
+	FormatOCIDir Format = "oci-dir"
+	// FormatDockerArchive is a tar archive that can be loaded with `docker load`.
+	FormatDockerArchive Format = "docker-archive"
+	// FormatK3s is an OCI archive with containerd image names, that k3s and RKE2
+	// automatically import from their agent images directory. An images list
+	// (eg. images.txt for images.tar.zst) is written alongside it.
+	FormatK3s Format = "k3s"
+)
+
+// CreateOptions are options for creating an image archive.
+type CreateOptions struct {
+	// Platform is the target platform for the image archive.
+	Platform *v1.Platform
+	// Format is the output format of the archive (defaults to FormatOCI).
+	Format Format
+	// Registries holds per-registry connection settings.
+	Registries *registry.Settings
+	// Progress reports the progress of layer downloads (optional).
+	Progress *progress.Reporter
+	// Base is the path to a previous archive (or its index.json). Blobs already
+	// present in the base are omitted from the new archive.
+	Base string
+	// Compression is the compression to apply to the archive. If nil, it's
+	// inferred from the output file extension.
+	Compression *compression.Options
+	// Artifacts are non-image OCI artifacts (eg. Helm charts) to add to the
+	// archive (only supported by the OCI formats).
+	Artifacts []*artifact.Artifact
+	// Manifests are Kubernetes manifest files to embed in the archive.
+	Manifests []ManifestFile
+	// VolumeSize splits the archive into numbered volumes of at most this
+	// many bytes (zero disables splitting).
+	VolumeSize int64
+	// Stream writes blobs directly into the archive as they are fetched,
+	// rather than staging the whole OCI layout in a temporary directory.
+	Stream bool
+	// Digests pins images (keyed by fully qualified reference name) to
+	// manifest digests, eg. from a lockfile. If set, images are fetched by
+	// digest, and every image must have an entry.
+	Digests map[string]v1.Hash
+}
+
+// fetchReference returns the reference to fetch an image from; its locked
+// digest if the images are pinned, otherwise the reference itself.
+func (opts CreateOptions) fetchReference(ref name.Reference) (name.Reference, error) {
+	if opts.Digests == nil {
+		return ref, nil
 	}
-	defer os.RemoveAll(ociLayoutDir)
 
-	p, err := layout.FromPath(ociLayoutDir)
-	if err != nil {
-		p, err = layout.Write(ociLayoutDir, empty.Index)
+	digest, ok := opts.Digests[ref.Name()]
+	if !ok {
+		return nil, errors.New("image is missing from the lockfile")
+	}
+
+	return ref.Context().Digest(digest.String()), nil
+}
+
+// Create creates an OCI image archive from a set of image references.
+// If outputPath is "-" the archive will be written to stdout.
+func Create(ctx context.Context, outputPath string, images sets.String, opts CreateOptions) (err error) {
+	var skip sets.String
+	var baseDigest v1.Hash
+	if opts.Base != "" {
+		if opts.Format == FormatDockerArchive {
+			return errors.New("incremental archives are not supported in the docker-archive format")
+		}
+
+		baseDigest, skip, err = loadBase(ctx, opts.Base, opts)
 		if err != nil {
-			return fmt.Errorf("failed to create image archive: %w", err)
+			return fmt.Errorf("failed to load base archive: %w", err)
 		}
+
+		slog.Info("Loaded base archive", "digest", baseDigest, "blobs", skip.Len())
+	}
+
+	if len(opts.Artifacts) > 0 && opts.Format != FormatOCI && opts.Format != FormatOCIDir && opts.Format != "" {
+		return fmt.Errorf("artifacts are not supported in the %s format", opts.Format)
+	}
+
+	// Docker archives have no index to record the compression in, so it's
+	// only ever inferred from (and recorded by) the output file extension.
+	if opts.Format == FormatDockerArchive && opts.Compression != nil {
+		return errors.New("compression options are not supported in the docker-archive format, use the output file extension instead")
 	}
 
-	for image := range images {
-		options := []remote.Option{
-			remote.WithContext(ctx),
-			remote.WithAuthFromKeychain(authn.DefaultKeychain),
+	if opts.Format == FormatOCIDir {
+		if outputPath == "-" {
+			return errors.New("cannot write an image layout directory to stdout")
+		}
+
+		if opts.Compression != nil && opts.Compression.Algorithm != compression.None {
+			return errors.New("image layout directories cannot be compressed")
 		}
 
-		if platform != nil {
-			options = append(options, remote.WithPlatform(*platform))
+		if opts.VolumeSize > 0 {
+			return errors.New("image layout directories cannot be split into volumes")
 		}
 
-		ref, err := name.ParseReference(image)
+		lw, err := newDirLayoutWriter(outputPath)
 		if err != nil {
-			return fmt.Errorf("failed to parse image reference %q: %w", image, err)
+			return err
 		}
 
-		slog.Info("Fetching image", "image", image)
+		iw := newOCIImageWriter(lw, skip)
+		if opts.Base != "" {
+			lw.SetAnnotation(AnnotationBaseDigest, baseDigest.String())
+		}
 
-		img, err := remote.Image(ref, options...)
-		if err != nil {
-			return fmt.Errorf("failed to fetch image %q: %w", image, err)
+		if err := writeImages(ctx, iw, images, opts); err != nil {
+			return err
 		}
 
-		layoutOpts := []layout.Option{
-			layout.WithAnnotations(map[string]string{
-				"org.opencontainers.image.ref.name": ref.String(),
-			}),
+		return iw.Close()
+	}
+
+	if opts.Format == FormatK3s {
+		if outputPath == "-" {
+			return errors.New("cannot write a k3s archive to stdout")
 		}
 
-		if platform != nil {
-			layoutOpts = append(layoutOpts, layout.WithPlatform(*platform))
+		listPath := imageListPath(outputPath)
+		if err := writeImageList(listPath, images, opts); err != nil {
+			return fmt.Errorf("failed to write image list: %w", err)
 		}
+		defer func() {
+			if err != nil {
+				_ = os.Remove(listPath)
+			}
+		}()
+	}
 
-		if err = p.AppendImage(img, layoutOpts...); err != nil {
-			return fmt.Errorf("failed to create image archive: %w", err)
+	out, closeOutput, err := openOutput(outputPath, opts.VolumeSize)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := closeOutput(err != nil); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	compressionOpts := outputCompression(outputPath, opts.Compression)
+
+	w, err := compression.NewWriter(out, compressionOpts)
+	if err != nil {
+		return fmt.Errorf("failed to create compressor: %w", err)
+	}
+
+	var iw imageWriter
+	switch opts.Format {
+	case FormatOCI, FormatK3s, "":
+		var lw layoutWriter
+		if opts.Stream {
+			lw = newTarLayoutWriter(w)
+		} else {
+			lw, err = newStagedLayoutWriter(w)
+			if err != nil {
+				return errors.Join(err, w.Close())
+			}
 		}
+
+		if opts.Base != "" {
+			lw.SetAnnotation(AnnotationBaseDigest, baseDigest.String())
+		}
+		lw.SetAnnotation(AnnotationCompression, compressionOpts.String())
+
+		oiw := newOCIImageWriter(lw, skip)
+		oiw.containerdNames = opts.Format == FormatK3s
+		iw = oiw
+	case FormatDockerArchive:
+		iw = newDockerArchiveWriter(w)
+	default:
+		return errors.Join(fmt.Errorf("unsupported archive format %q", opts.Format), w.Close())
+	}
+
+	if err := writeImages(ctx, iw, images, opts); err != nil {
+		discard(iw)
+		return errors.Join(err, w.Close())
 	}
 
 	slog.Info("Writing image archive", "path", outputPath)
 
-	outputFile, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+	if err := iw.Close(); err != nil {
+		return errors.Join(fmt.Errorf("failed to create oci image archive: %w", err), w.Close())
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close compressor: %w", err)
 	}
-	defer outputFile.Close()
 
-	// Optionally compress the output file based on the file extension.
-	w, err := uncompr.NewWriter(outputFile, filepath.Base(outputPath))
+	return nil
+}
+
+// outputCompression returns the compression to use for an archive, inferring
+// it from the file extension if not explicitly specified.
+func outputCompression(outputPath string, opts *compression.Options) compression.Options {
+	if opts != nil {
+		return *opts
+	}
+
+	return compression.Options{Algorithm: compression.FromFilename(outputPath)}
+}
+
+// newOutputLayoutWriter creates a layout writer for a new archive (FormatOCI)
+// or image layout directory (FormatOCIDir). The returned close function must
+// be called once the layout writer has been closed, or if writing failed.
+func newOutputLayoutWriter(outputPath string, format Format, compressionOpts *compression.Options) (layoutWriter, func(failed bool) error, error) {
+	switch format {
+	case FormatOCIDir:
+		dw, err := newDirLayoutWriter(outputPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return dw, func(bool) error { return nil }, nil
+	case FormatOCI, "":
+		out, closeOutput, err := openOutput(outputPath, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		opts := outputCompression(outputPath, compressionOpts)
+
+		w, err := compression.NewWriter(out, opts)
+		if err != nil {
+			_ = closeOutput(true)
+			return nil, nil, fmt.Errorf("failed to create compressor: %w", err)
+		}
+
+		lw := newTarLayoutWriter(w)
+		lw.SetAnnotation(AnnotationCompression, opts.String())
+
+		return lw, func(failed bool) error {
+			var err error
+			if closeErr := w.Close(); closeErr != nil {
+				err = fmt.Errorf("failed to close compressor: %w", closeErr)
+			}
+
+			if closeErr := closeOutput(failed || err != nil); closeErr != nil && err == nil {
+				err = closeErr
+			}
+
+			return err
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported archive format %q", format)
+	}
+}
+
+// openOutput opens the destination for an archive. The returned close function
+// finalizes the output, or removes it if the archive could not be created (so
+// that a truncated archive isn't left lying around).
+func openOutput(outputPath string, volumeSize int64) (io.Writer, func(failed bool) error, error) {
+	if outputPath == "-" {
+		if volumeSize > 0 {
+			return nil, nil, errors.New("cannot split an archive written to stdout into volumes")
+		}
+
+		return os.Stdout, func(bool) error { return nil }, nil
+	}
+
+	if volumeSize > 0 {
+		vw, err := volume.NewWriter(outputPath, volumeSize)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return vw, func(failed bool) error {
+			if failed {
+				return vw.Remove()
+			}
+
+			if err := vw.Close(); err != nil {
+				_ = vw.Remove()
+				return fmt.Errorf("failed to close volumes: %w", err)
+			}
+
+			return nil
+		}, nil
+	}
+
+	// Write to a temporary file alongside the output, and only rename it into
+	// place once complete. So a failure never leaves a partial archive behind,
+	// and the output can safely be one of the inputs (eg. when merging).
+	outputFile, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".*.tmp")
 	if err != nil {
-		return fmt.Errorf("failed to create compressor: %w", err)
+		return nil, nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+
+	if err := outputFile.Chmod(0o644); err != nil {
+		_ = outputFile.Close()
+		_ = os.Remove(outputFile.Name())
+		return nil, nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+
+	return outputFile, func(failed bool) error {
+		err := outputFile.Close()
+		if err == nil && !failed {
+			err = os.Rename(outputFile.Name(), outputPath)
+		}
+
+		if failed || err != nil {
+			_ = os.Remove(outputFile.Name())
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+
+		return nil
+	}, nil
+}
+
+// writeImages writes the embedded manifests, images and artifacts to an image
+// writer.
+func writeImages(ctx context.Context, iw imageWriter, images sets.String, opts CreateOptions) error {
+	if err := writeManifests(iw, opts.Manifests); err != nil {
+		return err
 	}
-	defer w.Close()
 
-	if err := tarfs.Create(w, os.DirFS(ociLayoutDir)); err != nil {
-		return fmt.Errorf("failed to create oci image archive: %w", err)
+	if err := appendImages(ctx, iw, images, opts); err != nil {
+		return err
+	}
+
+	return appendArtifacts(iw, opts.Artifacts)
+}
+
+func appendImages(ctx context.Context, iw imageWriter, images sets.String, opts CreateOptions) error {
+	for _, image := range images.List() {
+		ref, err := opts.Registries.ParseReference(image)
+		if err != nil {
+			return fmt.Errorf("failed to parse image reference %q: %w", image, err)
+		}
+
+		options := opts.Registries.RemoteOptions(ctx, ref.Context().Registry)
+		if opts.Platform != nil {
+			options = append(options, remote.WithPlatform(*opts.Platform))
+		}
+
+		fetchRef, err := opts.fetchReference(ref)
+		if err != nil {
+			return fmt.Errorf("failed to fetch image %q: %w", image, err)
+		}
+
+		slog.Info("Fetching image", "image", image)
+
+		img, err := remote.Image(fetchRef, options...)
+		if err != nil {
+			return fmt.Errorf("failed to fetch image %q: %w", image, err)
+		}
+
+		img = opts.Progress.WrapImage(image, img)
+
+		if err = iw.AppendImage(ref, img, opts.Platform); err != nil {
+			return fmt.Errorf("failed to append image %q: %w", image, err)
+		}
+	}
+
+	return nil
+}
+
+func appendArtifacts(iw imageWriter, artifacts []*artifact.Artifact) error {
+	for _, a := range artifacts {
+		slog.Info("Adding artifact", "artifact", a.RefName)
+
+		if err := iw.AppendArtifact(a); err != nil {
+			return fmt.Errorf("failed to append artifact %q: %w", a.RefName, err)
+		}
 	}
 
 	return nil
 }
+
+// refAnnotations returns the index annotations for an image reference.
+func refAnnotations(ref name.Reference) map[string]string {
+	return map[string]string{
+		AnnotationRefName: ref.String(),
+	}
+}
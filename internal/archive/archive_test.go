@@ -0,0 +1,1452 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/dpeckett/airgapify/internal/artifact"
+	"github.com/dpeckett/airgapify/internal/compression"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestCreate(t *testing.T) {
+	images := startRegistry(t, 2)
+
+	tests := []struct {
+		name   string
+		stream bool
+	}{
+		{name: "Staged"},
+		{name: "Stream", stream: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "images.tar")
+
+			err := archive.Create(context.Background(), outputPath, images, archive.CreateOptions{
+				Stream: tt.stream,
+			})
+			require.NoError(t, err)
+
+			f, err := os.Open(outputPath)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			fsys, err := tarfs.Open(f)
+			require.NoError(t, err)
+
+			_, err = fs.Stat(fsys, "oci-layout")
+			require.NoError(t, err)
+
+			indexJSON, err := fs.ReadFile(fsys, "index.json")
+			require.NoError(t, err)
+
+			var index v1.IndexManifest
+			require.NoError(t, json.Unmarshal(indexJSON, &index))
+
+			refNames := sets.NewString()
+			for _, desc := range index.Manifests {
+				refNames.Insert(desc.Annotations["org.opencontainers.image.ref.name"])
+
+				_, err := fs.Stat(fsys, filepath.Join("blobs", desc.Digest.Algorithm, desc.Digest.Hex))
+				require.NoError(t, err)
+			}
+
+			assert.True(t, images.Equal(refNames))
+		})
+	}
+}
+
+func TestCreateStreamFailure(t *testing.T) {
+	images := startRegistry(t, 1)
+
+	ref, err := name.ParseReference(images.List()[0])
+	require.NoError(t, err)
+
+	// Sorts after the existing image, so the failure happens part way through.
+	images.Insert(ref.Context().RegistryStr() + "/zz/missing:latest")
+
+	stdoutPath := filepath.Join(t.TempDir(), "stdout")
+	stdout, err := os.Create(stdoutPath)
+	require.NoError(t, err)
+
+	origStdout := os.Stdout
+	os.Stdout = stdout
+	t.Cleanup(func() {
+		os.Stdout = origStdout
+		require.NoError(t, stdout.Close())
+	})
+
+	err = archive.Create(context.Background(), "-", images, archive.CreateOptions{
+		Stream: true,
+	})
+	require.Error(t, err)
+
+	f, err := os.Open(stdoutPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		names = append(names, hdr.Name)
+	}
+
+	// The first image's blobs were streamed, but the archive wasn't finalized.
+	assert.NotEmpty(t, names)
+	assert.NotContains(t, names, "index.json")
+	assert.NotContains(t, names, "oci-layout")
+}
+
+func TestCreateOCIDir(t *testing.T) {
+	images := startRegistry(t, 2)
+
+	outputPath := filepath.Join(t.TempDir(), "images")
+
+	// Create the layout with one image, and then add both images to it.
+	first := sets.NewString(images.List()[0])
+	for _, images := range []sets.String{first, images} {
+		err := archive.Create(context.Background(), outputPath, images, archive.CreateOptions{
+			Format: archive.FormatOCIDir,
+		})
+		require.NoError(t, err)
+	}
+
+	p, err := layout.FromPath(outputPath)
+	require.NoError(t, err)
+
+	ii, err := p.ImageIndex()
+	require.NoError(t, err)
+
+	index, err := ii.IndexManifest()
+	require.NoError(t, err)
+
+	refNames := sets.NewString()
+	for _, desc := range index.Manifests {
+		refNames.Insert(desc.Annotations[archive.AnnotationRefName])
+	}
+
+	assert.Len(t, index.Manifests, 2)
+	assert.True(t, images.Equal(refNames))
+
+	// Each image has a manifest, a config and two layers.
+	blobs, err := os.ReadDir(filepath.Join(outputPath, "blobs", "sha256"))
+	require.NoError(t, err)
+
+	assert.Len(t, blobs, 8)
+
+	// Image layout directories can't be split into volumes.
+	volumesPath := filepath.Join(t.TempDir(), "volumes")
+
+	err = archive.Create(context.Background(), volumesPath, images, archive.CreateOptions{
+		Format:     archive.FormatOCIDir,
+		VolumeSize: 1024,
+	})
+	require.Error(t, err)
+
+	assert.NoDirExists(t, volumesPath)
+}
+
+func TestCreateDockerArchive(t *testing.T) {
+	images := startRegistry(t, 2)
+
+	// Tag the first image a second time.
+	first, err := name.ParseReference(images.List()[0])
+	require.NoError(t, err)
+
+	img, err := remote.Image(first)
+	require.NoError(t, err)
+
+	retagged := first.Context().Tag("stable")
+	require.NoError(t, remote.Write(retagged, img))
+
+	// Reference the second image by both tag and digest.
+	second, err := name.ParseReference(images.List()[1])
+	require.NoError(t, err)
+
+	secondImg, err := remote.Image(second)
+	require.NoError(t, err)
+
+	secondDigest, err := secondImg.Digest()
+	require.NoError(t, err)
+
+	pinned := second.Context().Tag("pinned")
+
+	expectedRepoTags := images.Union(sets.NewString(retagged.String(), pinned.String()))
+
+	images.Insert(retagged.String(), pinned.String()+"@"+secondDigest.String())
+
+	outputPath := filepath.Join(t.TempDir(), "images.tar")
+
+	err = archive.Create(context.Background(), outputPath, images, archive.CreateOptions{
+		Format: archive.FormatDockerArchive,
+	})
+	require.NoError(t, err)
+
+	f, err := os.Open(outputPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := tarfs.Open(f)
+	require.NoError(t, err)
+
+	manifestJSON, err := fs.ReadFile(fsys, "manifest.json")
+	require.NoError(t, err)
+
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	require.NoError(t, json.Unmarshal(manifestJSON, &manifest))
+
+	require.Len(t, manifest, 2)
+
+	repoTags := sets.NewString()
+	for _, entry := range manifest {
+		repoTags.Insert(entry.RepoTags...)
+
+		_, err := fs.Stat(fsys, entry.Config)
+		require.NoError(t, err)
+
+		for _, layer := range entry.Layers {
+			_, err := fs.Stat(fsys, layer)
+			require.NoError(t, err)
+		}
+	}
+
+	assert.Equal(t, expectedRepoTags.List(), repoTags.List())
+
+	_, err = fs.Stat(fsys, "repositories")
+	require.NoError(t, err)
+
+	// The compression can't be recorded in a docker archive, so it can only be
+	// inferred from the file extension.
+	err = archive.Create(context.Background(), filepath.Join(t.TempDir(), "images.tar"), images, archive.CreateOptions{
+		Format:      archive.FormatDockerArchive,
+		Compression: &compression.Options{Algorithm: compression.Gzip},
+	})
+	require.Error(t, err)
+}
+
+func TestCreateCompression(t *testing.T) {
+	images := startRegistry(t, 1)
+
+	tests := []struct {
+		name        string
+		outputName  string
+		compression *compression.Options
+		expected    string
+	}{
+		{name: "Inferred", outputName: "images.tar.gz", expected: "gzip"},
+		{name: "Uncompressed", outputName: "images.tar", expected: "none"},
+		{
+			name:        "Explicit",
+			outputName:  "images.tar",
+			compression: &compression.Options{Algorithm: compression.Zstd, Level: 19},
+			expected:    "zstd:19",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), tt.outputName)
+
+			err := archive.Create(context.Background(), outputPath, images, archive.CreateOptions{
+				Compression: tt.compression,
+			})
+			require.NoError(t, err)
+
+			a, err := archive.Open(outputPath)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, a.Close())
+			})
+
+			assert.Equal(t, tt.expected, a.Index().Annotations[archive.AnnotationCompression])
+		})
+	}
+}
+
+func TestCreateK3s(t *testing.T) {
+	images := startRegistry(t, 2)
+
+	// Reference the second image by both tag and digest (eg. from a lockfile).
+	second, err := name.ParseReference(images.List()[1])
+	require.NoError(t, err)
+
+	desc, err := remote.Head(second)
+	require.NoError(t, err)
+
+	pinned := second.Context().Tag("pinned").String() + "@" + desc.Digest.String()
+	images.Insert(pinned)
+
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "k3s-airgap-images.tar.zst")
+
+	err = archive.Create(context.Background(), outputPath, images, archive.CreateOptions{
+		Format: archive.FormatK3s,
+	})
+	require.NoError(t, err)
+
+	imageList, err := os.ReadFile(filepath.Join(dir, "k3s-airgap-images.txt"))
+	require.NoError(t, err)
+
+	assert.Equal(t, strings.Join(images.List(), "\n")+"\n", string(imageList))
+
+	a, err := archive.Open(outputPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+	})
+
+	require.Len(t, a.Index().Manifests, 3)
+
+	containerdNames := sets.NewString()
+	for _, desc := range a.Index().Manifests {
+		containerdNames.Insert(desc.Annotations[archive.AnnotationContainerdImageName])
+	}
+
+	// The tag is kept for references by both tag and digest.
+	assert.True(t, containerdNames.Has(pinned))
+	assert.Equal(t, images.List(), containerdNames.List())
+}
+
+func TestCreateManifests(t *testing.T) {
+	images := startRegistry(t, 1)
+
+	manifests := []archive.ManifestFile{
+		{Name: "000-deployment.yaml", Data: []byte("kind: Deployment\n")},
+		{Name: "001-service.yaml", Data: []byte("kind: Service\n")},
+	}
+
+	tests := []struct {
+		name       string
+		outputName string
+		format     archive.Format
+	}{
+		{name: "OCI", outputName: "images.tar.gz", format: archive.FormatOCI},
+		{name: "OCI Dir", outputName: "images", format: archive.FormatOCIDir},
+		{name: "Docker Archive", outputName: "images.tar", format: archive.FormatDockerArchive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), tt.outputName)
+
+			err := archive.Create(context.Background(), outputPath, images, archive.CreateOptions{
+				Format:    tt.format,
+				Manifests: manifests,
+			})
+			require.NoError(t, err)
+
+			extracted, err := archive.ExtractManifests(outputPath)
+			require.NoError(t, err)
+
+			assert.Equal(t, manifests, extracted)
+		})
+	}
+}
+
+func TestCreateArtifacts(t *testing.T) {
+	images := startRegistry(t, 1)
+
+	config := artifact.BytesBlob("application/vnd.example.config.v1+json", []byte("{}"), nil)
+	layer := artifact.BytesBlob("application/vnd.example.file.v1", []byte("hello"), nil)
+
+	a, err := artifact.New("files/hello:v1", "application/vnd.example", config, []artifact.Blob{layer}, nil)
+	require.NoError(t, err)
+
+	t.Run("OCI", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "images.tar")
+
+		err := archive.Create(context.Background(), outputPath, images, archive.CreateOptions{
+			Artifacts: []*artifact.Artifact{a},
+		})
+		require.NoError(t, err)
+
+		result, err := archive.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, result.Close())
+		})
+
+		var found bool
+		for _, desc := range result.Index().Manifests {
+			if desc.Annotations[archive.AnnotationRefName] == a.RefName {
+				found = true
+
+				assert.Equal(t, a.Descriptor().Digest, desc.Digest)
+				assert.Equal(t, "application/vnd.example", desc.ArtifactType)
+			}
+		}
+		assert.True(t, found)
+
+		for _, digest := range []v1.Hash{a.Descriptor().Digest, config.Digest, layer.Digest} {
+			assert.True(t, result.HasBlob(digest))
+		}
+	})
+
+	t.Run("Docker Archive", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "images.tar")
+
+		err := archive.Create(context.Background(), outputPath, images, archive.CreateOptions{
+			Format:    archive.FormatDockerArchive,
+			Artifacts: []*artifact.Artifact{a},
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestInspect(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	cf, err := img.ConfigFile()
+	require.NoError(t, err)
+
+	cf.OS, cf.Architecture, cf.Variant = "linux", "arm64", "v8"
+
+	img, err = mutate.ConfigFile(img, cf)
+	require.NoError(t, err)
+
+	require.NoError(t, p.AppendImage(img, layout.WithAnnotations(map[string]string{
+		archive.AnnotationRefName: "example.com/single:latest",
+	})))
+
+	var adds []mutate.IndexAddendum
+	for _, platform := range []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}, {OS: "unknown", Architecture: "unknown"}} {
+		img, err := random.Image(1024, 1)
+		require.NoError(t, err)
+
+		platform := platform
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &platform},
+		})
+	}
+
+	idx := mutate.AppendManifests(empty.Index, adds...)
+
+	require.NoError(t, p.AppendIndex(idx, layout.WithAnnotations(map[string]string{
+		archive.AnnotationRefName: "example.com/multi:latest",
+	})))
+
+	result, err := archive.Open(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, result.Close())
+	})
+
+	images, err := result.Inspect()
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	assert.Equal(t, "example.com/single:latest", images[0].RefName)
+	assert.Equal(t, imgDigest, images[0].Digest)
+	assert.Equal(t, []string{"linux/arm64/v8"}, images[0].Platforms)
+	assert.Equal(t, 2, images[0].Layers)
+
+	imgSize, err := img.Size()
+	require.NoError(t, err)
+
+	manifest, err := img.Manifest()
+	require.NoError(t, err)
+
+	expectedSize := imgSize + manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		expectedSize += layer.Size
+	}
+
+	assert.Equal(t, expectedSize, images[0].Size)
+
+	idxDigest, err := idx.Digest()
+	require.NoError(t, err)
+
+	assert.Equal(t, "example.com/multi:latest", images[1].RefName)
+	assert.Equal(t, idxDigest, images[1].Digest)
+	assert.Equal(t, types.OCIImageIndex, images[1].MediaType)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, images[1].Platforms)
+	assert.Equal(t, 3, images[1].Layers)
+}
+
+func TestVerify(t *testing.T) {
+	images := startRegistry(t, 2)
+
+	// createLayout creates an image layout directory, and returns the path to
+	// one of its layer blobs.
+	createLayout := func(t *testing.T) (string, string) {
+		outputPath := filepath.Join(t.TempDir(), "images")
+
+		err := archive.Create(context.Background(), outputPath, images, archive.CreateOptions{
+			Format: archive.FormatOCIDir,
+		})
+		require.NoError(t, err)
+
+		p, err := layout.FromPath(outputPath)
+		require.NoError(t, err)
+
+		ii, err := p.ImageIndex()
+		require.NoError(t, err)
+
+		index, err := ii.IndexManifest()
+		require.NoError(t, err)
+
+		img, err := ii.Image(index.Manifests[0].Digest)
+		require.NoError(t, err)
+
+		layers, err := img.Layers()
+		require.NoError(t, err)
+
+		digest, err := layers[0].Digest()
+		require.NoError(t, err)
+
+		return outputPath, filepath.Join(outputPath, "blobs", digest.Algorithm, digest.Hex)
+	}
+
+	verify := func(t *testing.T, archivePath string, images sets.String) *archive.VerifyResult {
+		a, err := archive.Open(archivePath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, a.Close())
+		})
+
+		result, err := a.Verify(images)
+		require.NoError(t, err)
+
+		return result
+	}
+
+	t.Run("Intact", func(t *testing.T) {
+		outputPath, _ := createLayout(t)
+
+		result := verify(t, outputPath, images)
+		assert.True(t, result.OK())
+		assert.Equal(t, 8, result.Blobs)
+		assert.Empty(t, result.Orphaned)
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		outputPath, layerPath := createLayout(t)
+
+		data, err := os.ReadFile(layerPath)
+		require.NoError(t, err)
+
+		data[0] ^= 0xff
+		require.NoError(t, os.WriteFile(layerPath, data, 0o644))
+
+		result := verify(t, outputPath, nil)
+		assert.False(t, result.OK())
+		require.Len(t, result.Corrupt, 1)
+		assert.Equal(t, filepath.Base(layerPath), result.Corrupt[0].Digest.Hex)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		outputPath, layerPath := createLayout(t)
+
+		require.NoError(t, os.Remove(layerPath))
+
+		result := verify(t, outputPath, nil)
+		assert.False(t, result.OK())
+		require.Len(t, result.Missing, 1)
+		assert.Equal(t, filepath.Base(layerPath), result.Missing[0].Digest.Hex)
+		assert.Contains(t, images, result.Missing[0].RefName)
+	})
+
+	t.Run("Orphaned", func(t *testing.T) {
+		outputPath, _ := createLayout(t)
+
+		digest, _, err := v1.SHA256(strings.NewReader("orphan"))
+		require.NoError(t, err)
+
+		require.NoError(t, os.WriteFile(filepath.Join(outputPath, "blobs", digest.Algorithm, digest.Hex), []byte("orphan"), 0o644))
+
+		result := verify(t, outputPath, nil)
+		assert.True(t, result.OK())
+		assert.Equal(t, []v1.Hash{digest}, result.Orphaned)
+	})
+
+	t.Run("Missing Image", func(t *testing.T) {
+		outputPath, _ := createLayout(t)
+
+		result := verify(t, outputPath, images.Union(sets.NewString("example.com/missing:latest")))
+		assert.False(t, result.OK())
+		assert.Equal(t, []string{"example.com/missing:latest"}, result.MissingImages)
+	})
+}
+
+func TestDiff(t *testing.T) {
+	images := startRegistry(t, 3).List()
+
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.tar")
+	require.NoError(t, archive.Create(context.Background(), oldPath, sets.NewString(images...), archive.CreateOptions{}))
+
+	// Push a new image to the first tag, and a completely new image.
+	changed, err := name.ParseReference(images[0])
+	require.NoError(t, err)
+
+	added := changed.Context().Tag("added")
+
+	for _, ref := range []name.Reference{changed, added} {
+		img, err := random.Image(1024, 2)
+		require.NoError(t, err)
+
+		require.NoError(t, remote.Write(ref, img))
+	}
+
+	// Tag the second image a second time.
+	retagged, err := name.ParseReference(images[1])
+	require.NoError(t, err)
+
+	img, err := remote.Image(retagged)
+	require.NoError(t, err)
+
+	stable := retagged.Context().Tag("stable")
+	require.NoError(t, remote.Write(stable, img))
+
+	// And drop the third image.
+	newPath := filepath.Join(dir, "new.tar")
+	require.NoError(t, archive.Create(context.Background(), newPath, sets.NewString(images[0], images[1], added.String(), stable.String()), archive.CreateOptions{}))
+
+	oldArchive, err := archive.Open(oldPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, oldArchive.Close())
+	})
+
+	newArchive, err := archive.Open(newPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, newArchive.Close())
+	})
+
+	result, err := archive.Diff(oldArchive, newArchive)
+	require.NoError(t, err)
+
+	require.Len(t, result.Added, 1)
+	assert.Equal(t, added.String(), result.Added[0].RefName)
+
+	require.Len(t, result.Removed, 1)
+	assert.Equal(t, images[2], result.Removed[0].RefName)
+
+	require.Len(t, result.Retagged, 1)
+	assert.Equal(t, stable.String(), result.Retagged[0].RefName)
+	assert.Equal(t, []string{images[1]}, result.Retagged[0].PreviousRefNames)
+
+	require.Len(t, result.Changed, 1)
+	assert.Equal(t, images[0], result.Changed[0].RefName)
+	assert.NotEqual(t, result.Changed[0].OldDigest, result.Changed[0].NewDigest)
+
+	// The changed and added images each have a manifest, a config and two layers.
+	assert.Equal(t, 8, result.NewBlobs)
+	assert.Greater(t, result.NewBytes, int64(4*1024))
+
+	// Drop the second tag of the second image, it should be reported as
+	// removed even though the image itself is still present.
+	untaggedPath := filepath.Join(dir, "untagged.tar")
+	require.NoError(t, archive.Create(context.Background(), untaggedPath, sets.NewString(images[0], images[1], added.String()), archive.CreateOptions{}))
+
+	untaggedArchive, err := archive.Open(untaggedPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, untaggedArchive.Close())
+	})
+
+	result, err = archive.Diff(newArchive, untaggedArchive)
+	require.NoError(t, err)
+
+	require.Len(t, result.Removed, 1)
+	assert.Equal(t, stable.String(), result.Removed[0].RefName)
+
+	assert.Empty(t, result.Added)
+	assert.Empty(t, result.Retagged)
+	assert.Empty(t, result.Changed)
+	assert.Zero(t, result.NewBlobs)
+}
+
+func TestMerge(t *testing.T) {
+	images := startRegistry(t, 3).List()
+
+	dir := t.TempDir()
+
+	createArchive := func(t *testing.T, name string, images ...string) string {
+		outputPath := filepath.Join(dir, name)
+		require.NoError(t, archive.Create(context.Background(), outputPath, sets.NewString(images...), archive.CreateOptions{}))
+		return outputPath
+	}
+
+	first := createArchive(t, "first.tar", images[0], images[1])
+	second := createArchive(t, "second.tar", images[1], images[2])
+
+	t.Run("Deduplicated", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "merged.tar")
+
+		conflicts, err := archive.Merge([]string{first, second}, outputPath, archive.MergeOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, conflicts)
+
+		result, err := archive.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, result.Close())
+		})
+
+		refNames := sets.NewString()
+		for _, desc := range result.Index().Manifests {
+			refNames.Insert(desc.Annotations[archive.AnnotationRefName])
+		}
+		assert.Equal(t, images, refNames.List())
+
+		// Each image has a manifest, a config and two layers.
+		blobs, err := result.Blobs()
+		require.NoError(t, err)
+		assert.Len(t, blobs, 12)
+	})
+
+	t.Run("In Place", func(t *testing.T) {
+		outputDir := t.TempDir()
+		outputPath := filepath.Join(outputDir, "first.tar")
+
+		data, err := os.ReadFile(first)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(outputPath, data, 0o644))
+
+		_, err = archive.Merge([]string{outputPath, second}, outputPath, archive.MergeOptions{})
+		require.NoError(t, err)
+
+		result, err := archive.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, result.Close())
+		})
+
+		refNames := sets.NewString()
+		for _, desc := range result.Index().Manifests {
+			refNames.Insert(desc.Annotations[archive.AnnotationRefName])
+		}
+		assert.Equal(t, images, refNames.List())
+
+		blobs, err := result.Blobs()
+		require.NoError(t, err)
+		assert.Len(t, blobs, 12)
+
+		// No temporary files should be left behind.
+		entries, err := os.ReadDir(outputDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("Manifests", func(t *testing.T) {
+		dir := t.TempDir()
+
+		createArchive := func(t *testing.T, name string, manifests ...archive.ManifestFile) string {
+			outputPath := filepath.Join(dir, name)
+			require.NoError(t, archive.Create(context.Background(), outputPath, sets.NewString(images[0]), archive.CreateOptions{
+				Manifests: manifests,
+			}))
+			return outputPath
+		}
+
+		common := archive.ManifestFile{Name: "001-common.yaml", Data: []byte("kind: Namespace\n")}
+		changed := archive.ManifestFile{Name: "001-common.yaml", Data: []byte("kind: ConfigMap\n")}
+		first := createArchive(t, "first.tar", archive.ManifestFile{Name: "000-a.yaml", Data: []byte("kind: Pod\n")}, common)
+		second := createArchive(t, "second.tar", common, archive.ManifestFile{Name: "002-b.yaml", Data: []byte("kind: Service\n")})
+		conflicting := createArchive(t, "conflicting.tar", changed)
+
+		outputPath := filepath.Join(dir, "merged.tar")
+
+		_, err := archive.Merge([]string{first, second}, outputPath, archive.MergeOptions{})
+		require.NoError(t, err)
+
+		manifests, err := archive.ExtractManifests(outputPath)
+		require.NoError(t, err)
+
+		var names []string
+		for _, m := range manifests {
+			names = append(names, m.Name)
+		}
+		assert.Equal(t, []string{"000-a.yaml", "001-common.yaml", "002-b.yaml"}, names)
+
+		_, err = archive.Merge([]string{first, conflicting}, filepath.Join(dir, "failed.tar"), archive.MergeOptions{})
+		require.Error(t, err)
+
+		_, err = archive.Merge([]string{first, conflicting}, outputPath, archive.MergeOptions{
+			Conflicts: archive.ConflictLast,
+		})
+		require.NoError(t, err)
+
+		manifests, err = archive.ExtractManifests(outputPath)
+		require.NoError(t, err)
+
+		require.Len(t, manifests, 2)
+		assert.Equal(t, changed, manifests[1])
+	})
+
+	// Push a new image to the first tag.
+	ref, err := name.ParseReference(images[0])
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, remote.Write(ref, img))
+
+	updatedDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	updated := createArchive(t, "updated.tar", images[0])
+
+	t.Run("Conflict", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "merged.tar")
+
+		conflicts, err := archive.Merge([]string{first, updated}, outputPath, archive.MergeOptions{})
+		require.Error(t, err)
+
+		require.Len(t, conflicts, 1)
+		assert.Equal(t, images[0], conflicts[0].RefName)
+		require.Len(t, conflicts[0].Digests, 2)
+		assert.Equal(t, updatedDigest, *conflicts[0].Digests[1])
+		assert.Nil(t, conflicts[0].Resolved)
+
+		_, err = os.Stat(outputPath)
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+
+	t.Run("Last", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "merged.tar")
+
+		conflicts, err := archive.Merge([]string{first, updated}, outputPath, archive.MergeOptions{
+			Conflicts: archive.ConflictLast,
+		})
+		require.NoError(t, err)
+
+		require.Len(t, conflicts, 1)
+		assert.Equal(t, updatedDigest, *conflicts[0].Resolved)
+
+		result, err := archive.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, result.Close())
+		})
+
+		for _, desc := range result.Index().Manifests {
+			if desc.Annotations[archive.AnnotationRefName] == images[0] {
+				assert.Equal(t, updatedDigest, desc.Digest)
+			}
+		}
+
+		// The image that was replaced isn't included.
+		blobs, err := result.Blobs()
+		require.NoError(t, err)
+		assert.Len(t, blobs, 8)
+	})
+}
+
+func TestRemove(t *testing.T) {
+	images := startRegistry(t, 3).List()
+
+	inputPath := filepath.Join(t.TempDir(), "images.tar")
+	err := archive.Create(context.Background(), inputPath, sets.NewString(images...), archive.CreateOptions{
+		Manifests: []archive.ManifestFile{{Name: "000-app.yaml", Data: []byte("kind: Pod\n")}},
+	})
+	require.NoError(t, err)
+
+	input, err := archive.Open(inputPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, input.Close())
+	})
+
+	digests := make(map[string]v1.Hash)
+	for _, desc := range input.Index().Manifests {
+		digests[desc.Annotations[archive.AnnotationRefName]] = desc.Digest
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		expected []string
+	}{
+		{name: "Reference", patterns: []string{images[0]}, expected: images[1:]},
+		{name: "Digest", patterns: []string{digests[images[1]].String()}, expected: []string{images[0], images[2]}},
+		{name: "Glob", patterns: []string{"*/test/image[01]:*"}, expected: images[2:]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "images.tar")
+
+			removed, err := archive.Remove(inputPath, outputPath, tt.patterns, archive.RemoveOptions{})
+			require.NoError(t, err)
+			assert.Len(t, removed, len(images)-len(tt.expected))
+
+			result, err := archive.Open(outputPath)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, result.Close())
+			})
+
+			refNames := sets.NewString()
+			for _, desc := range result.Index().Manifests {
+				refNames.Insert(desc.Annotations[archive.AnnotationRefName])
+			}
+			assert.Equal(t, tt.expected, refNames.List())
+
+			// Only the blobs of the remaining images are kept.
+			verified, err := result.Verify(nil)
+			require.NoError(t, err)
+			assert.True(t, verified.OK())
+			assert.Empty(t, verified.Orphaned)
+			assert.Equal(t, 4*len(tt.expected), verified.Blobs)
+
+			manifests, err := archive.ExtractManifests(outputPath)
+			require.NoError(t, err)
+			assert.Len(t, manifests, 1)
+		})
+	}
+
+	t.Run("No Match", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "images.tar")
+
+		_, err := archive.Remove(inputPath, outputPath, []string{"example.com/missing:latest"}, archive.RemoveOptions{})
+		require.Error(t, err)
+
+		_, err = os.Stat(outputPath)
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+
+	t.Run("In Place", func(t *testing.T) {
+		data, err := os.ReadFile(inputPath)
+		require.NoError(t, err)
+
+		path := filepath.Join(t.TempDir(), "images.tar")
+		require.NoError(t, os.WriteFile(path, data, 0o644))
+
+		// A failed removal leaves the archive untouched.
+		_, err = archive.Remove(path, path, []string{"example.com/missing:latest"}, archive.RemoveOptions{})
+		require.Error(t, err)
+
+		unchanged, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, data, unchanged)
+
+		removed, err := archive.Remove(path, path, []string{images[0]}, archive.RemoveOptions{})
+		require.NoError(t, err)
+		assert.Len(t, removed, 1)
+
+		result, err := archive.Open(path)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, result.Close())
+		})
+
+		refNames := sets.NewString()
+		for _, desc := range result.Index().Manifests {
+			refNames.Insert(desc.Annotations[archive.AnnotationRefName])
+		}
+		assert.Equal(t, images[1:], refNames.List())
+
+		verified, err := result.Verify(nil)
+		require.NoError(t, err)
+		assert.True(t, verified.OK())
+		assert.Equal(t, 4*len(images[1:]), verified.Blobs)
+	})
+
+	t.Run("Normalized", func(t *testing.T) {
+		// Reference names are stored as written, which needn't be the same form
+		// as the patterns.
+		dir := t.TempDir()
+
+		p, err := layout.Write(dir, empty.Index)
+		require.NoError(t, err)
+
+		refNames := []string{
+			"nginx:1.25",
+			"docker.io/library/nginx:1.26@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			"quay.io/team/app:v1",
+		}
+
+		for _, refName := range refNames {
+			img, err := random.Image(1024, 1)
+			require.NoError(t, err)
+
+			require.NoError(t, p.AppendImage(img, layout.WithAnnotations(map[string]string{
+				archive.AnnotationRefName: refName,
+			})))
+		}
+
+		tests := []struct {
+			name     string
+			pattern  string
+			expected []string
+		}{
+			{name: "Qualified Reference", pattern: "docker.io/library/nginx:1.25", expected: refNames[1:]},
+			{name: "Short Reference", pattern: "nginx:1.26", expected: []string{refNames[0], refNames[2]}},
+			{name: "Glob", pattern: "*/library/nginx:*", expected: refNames[2:]},
+			{name: "Glob As Written", pattern: "nginx:*", expected: refNames[1:]},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				outputPath := filepath.Join(t.TempDir(), "images.tar")
+
+				_, err := archive.Remove(dir, outputPath, []string{tt.pattern}, archive.RemoveOptions{})
+				require.NoError(t, err)
+
+				result, err := archive.Open(outputPath)
+				require.NoError(t, err)
+				t.Cleanup(func() {
+					require.NoError(t, result.Close())
+				})
+
+				var kept []string
+				for _, desc := range result.Index().Manifests {
+					kept = append(kept, desc.Annotations[archive.AnnotationRefName])
+				}
+				assert.Equal(t, tt.expected, kept)
+			})
+		}
+	})
+}
+
+func TestEstimateSize(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+
+	sharedLayer, err := random.Layer(1024, types.DockerLayer)
+	require.NoError(t, err)
+
+	images := sets.NewString()
+	for i := 0; i < 2; i++ {
+		img, err := random.Image(512, 1)
+		require.NoError(t, err)
+
+		img, err = mutate.AppendLayers(img, sharedLayer)
+		require.NoError(t, err)
+
+		ref, err := name.ParseReference(fmt.Sprintf("%s/test/image%d:latest", u.Host, i))
+		require.NoError(t, err)
+
+		require.NoError(t, remote.Write(ref, img))
+
+		images.Insert(ref.String())
+	}
+
+	estimate, err := archive.EstimateSize(context.Background(), images, archive.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Len(t, estimate.Images, 2)
+	assert.Equal(t, 3, estimate.UniqueLayers)
+	assert.Equal(t, 1, estimate.SharedLayers)
+
+	var sumOfImages int64
+	for _, img := range estimate.Images {
+		assert.Equal(t, 2, img.Layers)
+		assert.Equal(t, 1, img.SharedLayers)
+		sumOfImages += img.Size
+	}
+
+	sharedLayerSize, err := sharedLayer.Size()
+	require.NoError(t, err)
+
+	assert.Equal(t, sumOfImages-sharedLayerSize, estimate.TotalSize)
+	assert.Zero(t, estimate.ArtifactsSize)
+
+	// Artifacts and embedded manifests are included in the total.
+	config := artifact.BytesBlob("application/vnd.example.config.v1+json", []byte("{}"), nil)
+	layer := artifact.BytesBlob("application/vnd.example.file.v1", []byte("hello"), nil)
+
+	a, err := artifact.New("files/hello:v1", "application/vnd.example", config, []artifact.Blob{layer}, nil)
+	require.NoError(t, err)
+
+	manifest := archive.ManifestFile{Name: "000-app.yaml", Data: []byte("kind: Pod\n")}
+
+	withArtifacts, err := archive.EstimateSize(context.Background(), images, archive.CreateOptions{
+		Artifacts: []*artifact.Artifact{a},
+		Manifests: []archive.ManifestFile{manifest},
+	})
+	require.NoError(t, err)
+
+	expectedArtifactsSize := config.Size + layer.Size + a.Descriptor().Size + int64(len(manifest.Data))
+	assert.Equal(t, expectedArtifactsSize, withArtifacts.ArtifactsSize)
+	assert.Equal(t, estimate.TotalSize+expectedArtifactsSize, withArtifacts.TotalSize)
+}
+
+func TestCreateReproducible(t *testing.T) {
+	images := startRegistry(t, 3)
+
+	tests := []struct {
+		name       string
+		outputName string
+		opts       archive.CreateOptions
+	}{
+		{name: "Staged", outputName: "images.tar"},
+		{name: "Stream", outputName: "images.tar", opts: archive.CreateOptions{Stream: true}},
+		{name: "Compressed", outputName: "images.tar.gz"},
+		{name: "Docker Archive", outputName: "images.tar", opts: archive.CreateOptions{Format: archive.FormatDockerArchive}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var digests []v1.Hash
+			for i := 0; i < 2; i++ {
+				outputPath := filepath.Join(t.TempDir(), tt.outputName)
+
+				err := archive.Create(context.Background(), outputPath, images, tt.opts)
+				require.NoError(t, err)
+
+				f, err := os.Open(outputPath)
+				require.NoError(t, err)
+
+				digest, _, err := v1.SHA256(f)
+				require.NoError(t, err)
+				require.NoError(t, f.Close())
+
+				digests = append(digests, digest)
+			}
+
+			assert.Equal(t, digests[0], digests[1])
+		})
+	}
+
+	t.Run("Headers", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "images.tar")
+
+		err := archive.Create(context.Background(), outputPath, images, archive.CreateOptions{})
+		require.NoError(t, err)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		var names []string
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			names = append(names, hdr.Name)
+
+			assert.Zero(t, hdr.ModTime.Unix())
+			assert.Zero(t, hdr.Uid)
+			assert.Zero(t, hdr.Gid)
+			assert.Empty(t, hdr.Uname)
+			assert.Empty(t, hdr.Gname)
+		}
+
+		assert.True(t, sort.StringsAreSorted(names))
+	})
+
+	t.Run("Index Order", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "images")
+
+		// Add the images to the layout in reverse order.
+		list := images.List()
+		for i := len(list) - 1; i >= 0; i-- {
+			err := archive.Create(context.Background(), outputPath, sets.NewString(list[i]), archive.CreateOptions{
+				Format: archive.FormatOCIDir,
+			})
+			require.NoError(t, err)
+		}
+
+		a, err := archive.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, a.Close())
+		})
+
+		var refNames []string
+		for _, desc := range a.Index().Manifests {
+			refNames = append(refNames, desc.Annotations[archive.AnnotationRefName])
+		}
+
+		assert.Equal(t, list, refNames)
+	})
+}
+
+func TestCreateIncremental(t *testing.T) {
+	images := startRegistry(t, 2)
+	first := sets.NewString(images.List()[0])
+
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.tar")
+
+	err := archive.Create(context.Background(), basePath, first, archive.CreateOptions{})
+	require.NoError(t, err)
+
+	base, err := archive.Open(basePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, base.Close())
+	})
+
+	// Extract the base index, to test creating a delta from just the index.
+	baseIndexPath := filepath.Join(dir, "index.json")
+	rawIndex, err := json.Marshal(base.Index())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(baseIndexPath, rawIndex, 0o644))
+
+	tests := []struct {
+		name string
+		base string
+	}{
+		{name: "Archive", base: basePath},
+		{name: "Index", base: baseIndexPath},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deltaPath := filepath.Join(t.TempDir(), "delta.tar")
+
+			err := archive.Create(context.Background(), deltaPath, images, archive.CreateOptions{
+				Base: tt.base,
+			})
+			require.NoError(t, err)
+
+			delta, err := archive.Open(deltaPath)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, delta.Close())
+			})
+
+			baseDigest := base.Digest()
+			if tt.base == baseIndexPath {
+				baseDigest, _, err = v1.SHA256(bytes.NewReader(rawIndex))
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, baseDigest.String(), delta.Index().Annotations[archive.AnnotationBaseDigest])
+			assert.Len(t, delta.Index().Manifests, 2)
+
+			// Only the second image's blobs are in the delta.
+			blobs, err := delta.Blobs()
+			require.NoError(t, err)
+
+			assert.Len(t, blobs, 4)
+		})
+	}
+
+	t.Run("Apply", func(t *testing.T) {
+		deltaPath := filepath.Join(t.TempDir(), "delta.tar")
+
+		err := archive.Create(context.Background(), deltaPath, images, archive.CreateOptions{
+			Base:      basePath,
+			Manifests: []archive.ManifestFile{{Name: "000-app.yaml", Data: []byte("kind: Pod\n")}},
+		})
+		require.NoError(t, err)
+
+		outputPath := filepath.Join(t.TempDir(), "images.tar.gz")
+		err = archive.Apply(context.Background(), deltaPath, basePath, outputPath, archive.ApplyOptions{})
+		require.NoError(t, err)
+
+		result, err := archive.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, result.Close())
+		})
+
+		_, ok := result.Index().Annotations[archive.AnnotationBaseDigest]
+		assert.False(t, ok)
+		assert.Equal(t, "gzip", result.Index().Annotations[archive.AnnotationCompression])
+		assert.Len(t, result.Index().Manifests, 2)
+
+		blobs, err := result.Blobs()
+		require.NoError(t, err)
+
+		assert.Len(t, blobs, 8)
+
+		// The delta's embedded manifests are carried over.
+		manifests, err := archive.ExtractManifests(outputPath)
+		require.NoError(t, err)
+
+		require.Len(t, manifests, 1)
+		assert.Equal(t, "000-app.yaml", manifests[0].Name)
+	})
+
+	t.Run("Apply In Place", func(t *testing.T) {
+		baseDir := filepath.Join(t.TempDir(), "base")
+		err := archive.Create(context.Background(), baseDir, first, archive.CreateOptions{
+			Format:    archive.FormatOCIDir,
+			Manifests: []archive.ManifestFile{{Name: "000-old.yaml", Data: []byte("kind: Pod\n")}},
+		})
+		require.NoError(t, err)
+
+		deltaPath := filepath.Join(t.TempDir(), "delta.tar")
+		err = archive.Create(context.Background(), deltaPath, images, archive.CreateOptions{
+			Base:      baseDir,
+			Manifests: []archive.ManifestFile{{Name: "001-new.yaml", Data: []byte("kind: Pod\n")}},
+		})
+		require.NoError(t, err)
+
+		err = archive.Apply(context.Background(), deltaPath, baseDir, "", archive.ApplyOptions{})
+		require.NoError(t, err)
+
+		manifests, err := archive.ExtractManifests(baseDir)
+		require.NoError(t, err)
+
+		require.Len(t, manifests, 1)
+		assert.Equal(t, "001-new.yaml", manifests[0].Name)
+
+		p, err := layout.FromPath(baseDir)
+		require.NoError(t, err)
+
+		ii, err := p.ImageIndex()
+		require.NoError(t, err)
+
+		index, err := ii.IndexManifest()
+		require.NoError(t, err)
+
+		assert.Len(t, index.Manifests, 2)
+
+		// Applying the delta a second time should fail, as the base has changed.
+		err = archive.Apply(context.Background(), deltaPath, baseDir, "", archive.ApplyOptions{})
+		require.ErrorContains(t, err, "does not match")
+	})
+
+	t.Run("Apply Missing Blob", func(t *testing.T) {
+		baseDir := filepath.Join(t.TempDir(), "base")
+		err := archive.Create(context.Background(), baseDir, first, archive.CreateOptions{
+			Format: archive.FormatOCIDir,
+		})
+		require.NoError(t, err)
+
+		deltaPath := filepath.Join(t.TempDir(), "delta.tar")
+		err = archive.Create(context.Background(), deltaPath, images, archive.CreateOptions{
+			Base: baseDir,
+		})
+		require.NoError(t, err)
+
+		// Remove a blob that only the base has.
+		baseBlobs := blobDigests(t, baseDir)
+		deltaBlobs := blobDigests(t, deltaPath)
+
+		removed, err := v1.NewHash(baseBlobs.Difference(deltaBlobs).List()[0])
+		require.NoError(t, err)
+
+		require.NoError(t, os.Remove(filepath.Join(baseDir, "blobs", removed.Algorithm, removed.Hex)))
+
+		outputPath := filepath.Join(t.TempDir(), "images.tar")
+		err = archive.Apply(context.Background(), deltaPath, baseDir, outputPath, archive.ApplyOptions{})
+		require.Error(t, err)
+
+		_, err = os.Stat(outputPath)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+// blobDigests returns the digests of all the blobs in an archive.
+func blobDigests(t *testing.T, archivePath string) sets.String {
+	a, err := archive.Open(archivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+	})
+
+	blobs, err := a.Blobs()
+	require.NoError(t, err)
+
+	digests := sets.NewString()
+	for _, digest := range blobs {
+		digests.Insert(digest.String())
+	}
+
+	return digests
+}
+
+// startRegistry starts an in-memory registry populated with n random images,
+// and returns their references.
+func startRegistry(t *testing.T, n int) sets.String {
+	s := httptest.NewServer(registry.New())
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+
+	images := sets.NewString()
+	for i := 0; i < n; i++ {
+		img, err := random.Image(1024, 2)
+		require.NoError(t, err)
+
+		ref, err := name.ParseReference(fmt.Sprintf("%s/test/image%d:latest", u.Host, i))
+		require.NoError(t, err)
+
+		require.NoError(t, remote.Write(ref, img))
+
+		images.Insert(ref.String())
+	}
+
+	return images
+}
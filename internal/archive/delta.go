@@ -0,0 +1,262 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpeckett/airgapify/internal/compression"
+	"github.com/dpeckett/airgapify/internal/volume"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// loadBase returns the digest of a base archive, and the set of blobs it
+// contains. The base may be an archive, or just its index.json, in which case
+// the blobs are discovered by fetching the indexed manifests from their
+// registries.
+func loadBase(ctx context.Context, basePath string, opts CreateOptions) (v1.Hash, sets.String, error) {
+	if strings.HasSuffix(basePath, ".json") && !volume.IsManifest(basePath) {
+		return loadBaseIndex(ctx, basePath, opts)
+	}
+
+	base, err := Open(basePath)
+	if err != nil {
+		return v1.Hash{}, nil, err
+	}
+	defer base.Close()
+
+	blobs, err := base.Blobs()
+	if err != nil {
+		return v1.Hash{}, nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	skip := sets.NewString()
+	for _, digest := range blobs {
+		skip.Insert(digest.String())
+	}
+
+	return base.Digest(), skip, nil
+}
+
+func loadBaseIndex(ctx context.Context, indexPath string, opts CreateOptions) (v1.Hash, sets.String, error) {
+	rawIndex, err := os.ReadFile(indexPath)
+	if err != nil {
+		return v1.Hash{}, nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var index v1.IndexManifest
+	if err := json.Unmarshal(rawIndex, &index); err != nil {
+		return v1.Hash{}, nil, fmt.Errorf("failed to parse index: %w", err)
+	}
+
+	skip := sets.NewString()
+	for _, desc := range index.Manifests {
+		refName, ok := desc.Annotations[AnnotationRefName]
+		if !ok {
+			return v1.Hash{}, nil, fmt.Errorf("index entry %s has no reference name", desc.Digest)
+		}
+
+		ref, err := opts.Registries.ParseReference(refName)
+		if err != nil {
+			return v1.Hash{}, nil, fmt.Errorf("failed to parse image reference %q: %w", refName, err)
+		}
+
+		repo := ref.Context()
+		options := opts.Registries.RemoteOptions(ctx, repo.Registry)
+
+		slog.Info("Fetching base manifest", "image", refName, "digest", desc.Digest)
+
+		// Fetch the manifests by digest, as the tag may have moved since the
+		// base archive was created.
+		readBlob := func(desc v1.Descriptor) ([]byte, error) {
+			rd, err := remote.Get(repo.Digest(desc.Digest.String()), options...)
+			if err != nil {
+				return nil, err
+			}
+
+			return rd.Manifest, nil
+		}
+
+		err = walkDescriptors([]v1.Descriptor{desc}, readBlob, func(desc v1.Descriptor) error {
+			skip.Insert(desc.Digest.String())
+			return nil
+		})
+		if err != nil {
+			return v1.Hash{}, nil, fmt.Errorf("failed to resolve base image %q: %w", refName, err)
+		}
+	}
+
+	sum := sha256.Sum256(rawIndex)
+	return v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}, skip, nil
+}
+
+// ApplyOptions are options for applying an incremental archive.
+type ApplyOptions struct {
+	// Format is the output format of the archive (FormatOCI or FormatOCIDir).
+	Format Format
+	// Compression is the compression to apply to the archive. If nil, it's
+	// inferred from the output file extension.
+	Compression *compression.Options
+}
+
+// Apply combines an incremental archive with the base archive it was created
+// against, writing a complete archive to outputPath. If outputPath is empty,
+// the base (which must be an image layout directory) is updated in place.
+func Apply(ctx context.Context, deltaPath, basePath, outputPath string, opts ApplyOptions) (err error) {
+	delta, err := Open(deltaPath)
+	if err != nil {
+		return fmt.Errorf("failed to open incremental archive: %w", err)
+	}
+	defer delta.Close()
+
+	base, err := Open(basePath)
+	if err != nil {
+		return fmt.Errorf("failed to open base archive: %w", err)
+	}
+	defer base.Close()
+
+	expectedDigest, ok := delta.Index().Annotations[AnnotationBaseDigest]
+	if !ok {
+		return fmt.Errorf("%s is not an incremental archive", deltaPath)
+	}
+
+	if baseDigest := base.Digest(); baseDigest.String() != expectedDigest {
+		return fmt.Errorf("base archive digest %s does not match the expected base %s", baseDigest, expectedDigest)
+	}
+
+	var lw layoutWriter
+	if outputPath == "" {
+		fi, err := os.Stat(basePath)
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			return errors.New("an output path is required unless the base is an image layout directory")
+		}
+
+		dw, err := newDirLayoutWriter(basePath)
+		if err != nil {
+			return err
+		}
+
+		// The delta's index describes the complete image set.
+		dw.index = emptyIndex()
+		lw = dw
+	} else if opts.Format == FormatOCIDir {
+		if lw, err = newDirLayoutWriter(outputPath); err != nil {
+			return err
+		}
+	} else if opts.Format == FormatOCI || opts.Format == "" {
+		var out io.Writer
+		var closeOutput func(failed bool) error
+		out, closeOutput, err = openOutput(outputPath, 0)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := closeOutput(err != nil); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}()
+
+		compressionOpts := outputCompression(outputPath, opts.Compression)
+
+		var w io.WriteCloser
+		w, err = compression.NewWriter(out, compressionOpts)
+		if err != nil {
+			return fmt.Errorf("failed to create compressor: %w", err)
+		}
+		defer func() {
+			if closeErr := w.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("failed to close compressor: %w", closeErr)
+			}
+		}()
+
+		lw = newTarLayoutWriter(w)
+		lw.SetAnnotation(AnnotationCompression, compressionOpts.String())
+	} else {
+		return fmt.Errorf("unsupported archive format %q", opts.Format)
+	}
+
+	// Blobs are taken from the delta if present, otherwise from the base.
+	// The index isn't written if the result would be incomplete (and in the
+	// in-place case, the base's index is left untouched).
+	if err := copyImages(lw, []*Archive{delta, base}, delta.Index().Manifests); err != nil {
+		return err
+	}
+
+	// Like the index, the delta's embedded manifests replace the base's.
+	if outputPath == "" {
+		if err := os.RemoveAll(filepath.Join(basePath, ManifestsDir)); err != nil {
+			return fmt.Errorf("failed to remove embedded manifests: %w", err)
+		}
+	}
+
+	if err := copyManifests(lw, delta); err != nil {
+		return err
+	}
+
+	for key, value := range delta.Index().Annotations {
+		if key != AnnotationBaseDigest && key != AnnotationCompression {
+			lw.SetAnnotation(key, value)
+		}
+	}
+
+	slog.Info("Writing image archive", "path", outputPath)
+
+	return lw.Close()
+}
+
+// copyBlob copies a blob from an archive into a layout, verifying its digest.
+func copyBlob(lw layoutWriter, a *Archive, digest v1.Hash) error {
+	size, err := a.BlobSize(digest)
+	if err != nil {
+		return err
+	}
+
+	rc, err := a.Blob(digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	r, err := newVerifyingReader(rc, digest)
+	if err != nil {
+		return err
+	}
+
+	if err := lw.WriteBlob(digest, size, r); err != nil {
+		return fmt.Errorf("failed to copy blob %s: %w", digest, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"sort"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// DiffImage is an image that was added to (or removed from) an archive.
+type DiffImage struct {
+	RefName string  `json:"refName"`
+	Digest  v1.Hash `json:"digest"`
+}
+
+// DiffRetag is an image that already existed, but under a different
+// reference name.
+type DiffRetag struct {
+	RefName string  `json:"refName"`
+	Digest  v1.Hash `json:"digest"`
+	// PreviousRefNames are the reference names the image had previously.
+	PreviousRefNames []string `json:"previousRefNames"`
+}
+
+// DiffChange is a reference name that points to a different image.
+type DiffChange struct {
+	RefName   string  `json:"refName"`
+	OldDigest v1.Hash `json:"oldDigest"`
+	NewDigest v1.Hash `json:"newDigest"`
+}
+
+// DiffResult is the difference between two archives.
+type DiffResult struct {
+	// Added are images that are new.
+	Added []DiffImage `json:"added,omitempty"`
+	// Removed are reference names that are no longer present (even if the
+	// image is still present under another name).
+	Removed []DiffImage `json:"removed,omitempty"`
+	// Retagged are new reference names for images that were already present
+	// under another name.
+	Retagged []DiffRetag `json:"retagged,omitempty"`
+	// Changed are reference names whose digest has changed.
+	Changed []DiffChange `json:"changed,omitempty"`
+	// NewBlobs is the number of blobs that weren't in the old archive.
+	NewBlobs int `json:"newBlobs"`
+	// NewBytes is the total size of the new blobs.
+	NewBytes int64 `json:"newBytes"`
+}
+
+// Diff compares the images in two archives. Entries in the index are matched
+// by reference name (or digest, for entries without one).
+func Diff(oldArchive, newArchive *Archive) (*DiffResult, error) {
+	oldRefs, oldDigests := indexRefs(oldArchive)
+	newRefs, _ := indexRefs(newArchive)
+
+	result := &DiffResult{}
+
+	for _, refName := range sets.StringKeySet(newRefs).List() {
+		digest := newRefs[refName]
+
+		oldDigest, ok := oldRefs[refName]
+		switch {
+		case ok && oldDigest != digest:
+			result.Changed = append(result.Changed, DiffChange{RefName: refName, OldDigest: oldDigest, NewDigest: digest})
+		case ok:
+		case oldDigests[digest] != nil:
+			result.Retagged = append(result.Retagged, DiffRetag{RefName: refName, Digest: digest, PreviousRefNames: oldDigests[digest]})
+		default:
+			result.Added = append(result.Added, DiffImage{RefName: refName, Digest: digest})
+		}
+	}
+
+	for _, refName := range sets.StringKeySet(oldRefs).List() {
+		if _, ok := newRefs[refName]; !ok {
+			result.Removed = append(result.Removed, DiffImage{RefName: refName, Digest: oldRefs[refName]})
+		}
+	}
+
+	oldBlobs := sets.NewString()
+	err := oldArchive.Walk(oldArchive.Index().Manifests, func(desc v1.Descriptor) error {
+		oldBlobs.Insert(desc.Digest.String())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = newArchive.Walk(newArchive.Index().Manifests, func(desc v1.Descriptor) error {
+		if !oldBlobs.Has(desc.Digest.String()) {
+			result.NewBlobs++
+			result.NewBytes += desc.Size
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// indexRefs returns the digests of the images in an archive's index by
+// reference name, and the (sorted) reference names of each digest.
+func indexRefs(a *Archive) (map[string]v1.Hash, map[v1.Hash][]string) {
+	refs := make(map[string]v1.Hash)
+	digests := make(map[v1.Hash][]string)
+
+	for _, desc := range a.Index().Manifests {
+		refName, ok := desc.Annotations[AnnotationRefName]
+		if !ok {
+			refName = desc.Digest.String()
+		}
+
+		refs[refName] = desc.Digest
+		digests[desc.Digest] = append(digests[desc.Digest], refName)
+	}
+
+	for _, refNames := range digests {
+		sort.Strings(refNames)
+	}
+
+	return refs, digests
+}
@@ -0,0 +1,243 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/dpeckett/airgapify/internal/artifact"
+	"github.com/dpeckett/airgapify/internal/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// dockerManifestEntry is an entry in the manifest.json of a docker archive.
+type dockerManifestEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// dockerArchiveWriter streams images into a tar archive in the format
+// produced by `docker save` (and understood by `docker load`).
+type dockerArchiveWriter struct {
+	tw    *tar.Writer
+	files sets.String
+	// entries is indexed by image manifest digest, so that images referenced
+	// by multiple tags are only written once.
+	entries map[v1.Hash]*dockerManifestEntry
+	order   []v1.Hash
+	// repositories maps repository -> tag -> top layer.
+	repositories map[string]map[string]string
+}
+
+func newDockerArchiveWriter(dst io.Writer) *dockerArchiveWriter {
+	return &dockerArchiveWriter{
+		tw:           tar.NewWriter(dst),
+		files:        sets.NewString(),
+		entries:      make(map[v1.Hash]*dockerManifestEntry),
+		repositories: make(map[string]map[string]string),
+	}
+}
+
+func (w *dockerArchiveWriter) AppendImage(ref name.Reference, img v1.Image, _ *v1.Platform) error {
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+
+	entry, ok := w.entries[digest]
+	if !ok {
+		entry, err = w.writeImage(img)
+		if err != nil {
+			return err
+		}
+
+		w.entries[digest] = entry
+		w.order = append(w.order, digest)
+	}
+
+	// Docker can only tag images by tag (not digest).
+	tag, ok := util.ReferenceTag(ref)
+	if !ok {
+		slog.Warn("Image is referenced by digest only, it will be untagged when loaded", "image", ref.String())
+		return nil
+	}
+
+	repo := familiarName(tag.Context())
+	repoTag := repo + ":" + tag.TagStr()
+
+	if !sets.NewString(entry.RepoTags...).Has(repoTag) {
+		entry.RepoTags = append(entry.RepoTags, repoTag)
+	}
+
+	if len(entry.Layers) > 0 {
+		if w.repositories[repo] == nil {
+			w.repositories[repo] = make(map[string]string)
+		}
+
+		topLayer := entry.Layers[len(entry.Layers)-1]
+		w.repositories[repo][tag.TagStr()] = strings.SplitN(topLayer, ".", 2)[0]
+	}
+
+	return nil
+}
+
+func (w *dockerArchiveWriter) writeImage(img v1.Image) (*dockerManifestEntry, error) {
+	configName, err := img.ConfigName()
+	if err != nil {
+		return nil, err
+	}
+
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &dockerManifestEntry{
+		Config: configName.Hex + ".json",
+	}
+
+	if err := w.writeFile(entry.Config, int64(len(rawConfig)), bytes.NewReader(rawConfig)); err != nil {
+		return nil, fmt.Errorf("failed to write config: %w", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+
+		layerFile := digest.Hex + layerFileExtension(mediaType)
+		entry.Layers = append(entry.Layers, layerFile)
+
+		if w.files.Has(layerFile) {
+			continue
+		}
+
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+
+		err = w.writeFile(layerFile, size, rc)
+		_ = rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to write layer %s: %w", digest, err)
+		}
+	}
+
+	return entry, nil
+}
+
+func (w *dockerArchiveWriter) AppendArtifact(a *artifact.Artifact) error {
+	return fmt.Errorf("cannot add artifact %q to a docker archive", a.RefName)
+}
+
+func (w *dockerArchiveWriter) WriteFile(name string, data []byte) error {
+	return w.writeFile(name, int64(len(data)), bytes.NewReader(data))
+}
+
+func (w *dockerArchiveWriter) Close() error {
+	manifest := make([]*dockerManifestEntry, 0, len(w.order))
+	for _, digest := range w.order {
+		entry := w.entries[digest]
+		if entry.RepoTags == nil {
+			entry.RepoTags = []string{}
+		}
+
+		manifest = append(manifest, entry)
+	}
+
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := w.writeFile("manifest.json", int64(len(rawManifest)), bytes.NewReader(rawManifest)); err != nil {
+		return err
+	}
+
+	rawRepositories, err := json.Marshal(w.repositories)
+	if err != nil {
+		return err
+	}
+
+	if err := w.writeFile("repositories", int64(len(rawRepositories)), bytes.NewReader(rawRepositories)); err != nil {
+		return err
+	}
+
+	return w.tw.Close()
+}
+
+func (w *dockerArchiveWriter) writeFile(name string, size int64, r io.Reader) error {
+	if err := writeTarEntry(w.tw, name, size, r); err != nil {
+		return err
+	}
+
+	w.files.Insert(name)
+
+	return nil
+}
+
+// familiarName returns the short form of a repository name that Docker uses
+// (eg. "nginx" rather than "index.docker.io/library/nginx").
+func familiarName(repo name.Repository) string {
+	if repo.RegistryStr() != name.DefaultRegistry {
+		return repo.Name()
+	}
+
+	return strings.TrimPrefix(repo.RepositoryStr(), "library/")
+}
+
+// layerFileExtension returns a file extension matching the compression of a
+// layer (docker load detects the compression from the contents).
+func layerFileExtension(mediaType types.MediaType) string {
+	switch mediaType {
+	case types.DockerLayer, types.OCILayer, types.DockerForeignLayer, types.OCIRestrictedLayer:
+		return ".tar.gz"
+	case types.OCILayerZStd:
+		return ".tar.zst"
+	default:
+		return ".tar"
+	}
+}
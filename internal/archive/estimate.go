@@ -0,0 +1,189 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// ImageEstimate is the estimated contribution of a single image to an archive.
+type ImageEstimate struct {
+	// Image is the image reference.
+	Image string
+	// Digest is the digest of the resolved image manifest.
+	Digest v1.Hash
+	// Layers is the number of layers in the image.
+	Layers int
+	// SharedLayers is the number of layers also referenced by other images.
+	SharedLayers int
+	// Size is the total compressed size of the image (manifest, config and layers).
+	Size int64
+}
+
+// Estimate is the estimated size of an image archive.
+type Estimate struct {
+	// Images is the per-image estimates, ordered by image reference.
+	Images []ImageEstimate
+	// UniqueLayers is the number of distinct layers in the archive.
+	UniqueLayers int
+	// SharedLayers is the number of distinct layers referenced by more than one image.
+	SharedLayers int
+	// ArtifactsSize is the total size of the artifacts (eg. Helm charts) and
+	// embedded manifests that aren't shared with any images (or present in
+	// the base archive).
+	ArtifactsSize int64
+	// TotalSize is the total size of all unique blobs in the archive,
+	// including artifacts and embedded manifests (excluding any blobs already
+	// present in the base archive).
+	TotalSize int64
+}
+
+// EstimateSize resolves each image reference to its manifest (without
+// downloading any layers) and estimates the size of the resulting archive,
+// including any artifacts and embedded manifests.
+func EstimateSize(ctx context.Context, images sets.String, opts CreateOptions) (*Estimate, error) {
+	var manifests []*v1.Manifest
+	var estimate Estimate
+
+	blobSizes := make(map[v1.Hash]int64)
+	layerRefs := make(map[v1.Hash]int)
+
+	for _, image := range images.List() {
+		ref, err := opts.Registries.ParseReference(image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse image reference %q: %w", image, err)
+		}
+
+		options := opts.Registries.RemoteOptions(ctx, ref.Context().Registry)
+		if opts.Platform != nil {
+			options = append(options, remote.WithPlatform(*opts.Platform))
+		}
+
+		fetchRef, err := opts.fetchReference(ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve image %q: %w", image, err)
+		}
+
+		slog.Debug("Resolving image", "image", image)
+
+		img, err := remote.Image(fetchRef, options...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve image %q: %w", image, err)
+		}
+
+		digest, err := img.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve image %q: %w", image, err)
+		}
+
+		manifestSize, err := img.Size()
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve image %q: %w", image, err)
+		}
+
+		manifest, err := img.Manifest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve image %q: %w", image, err)
+		}
+
+		imageEstimate := ImageEstimate{
+			Image:  image,
+			Digest: digest,
+			Layers: len(manifest.Layers),
+			Size:   manifestSize + manifest.Config.Size,
+		}
+
+		blobSizes[digest] = manifestSize
+		blobSizes[manifest.Config.Digest] = manifest.Config.Size
+
+		// Count each layer once per image.
+		seen := make(map[v1.Hash]bool)
+		for _, layer := range manifest.Layers {
+			imageEstimate.Size += layer.Size
+			blobSizes[layer.Digest] = layer.Size
+
+			if !seen[layer.Digest] {
+				seen[layer.Digest] = true
+				layerRefs[layer.Digest]++
+			}
+		}
+
+		manifests = append(manifests, manifest)
+		estimate.Images = append(estimate.Images, imageEstimate)
+	}
+
+	for i, manifest := range manifests {
+		seen := make(map[v1.Hash]bool)
+		for _, layer := range manifest.Layers {
+			if !seen[layer.Digest] && layerRefs[layer.Digest] > 1 {
+				estimate.Images[i].SharedLayers++
+			}
+			seen[layer.Digest] = true
+		}
+	}
+
+	for _, refs := range layerRefs {
+		estimate.UniqueLayers++
+		if refs > 1 {
+			estimate.SharedLayers++
+		}
+	}
+
+	var skip sets.String
+	if opts.Base != "" {
+		var err error
+		if _, skip, err = loadBase(ctx, opts.Base, opts); err != nil {
+			return nil, fmt.Errorf("failed to load base archive: %w", err)
+		}
+	}
+
+	for digest, size := range blobSizes {
+		if !skip.Has(digest.String()) {
+			estimate.TotalSize += size
+		}
+	}
+
+	artifactBlobSizes := make(map[v1.Hash]int64)
+	for _, a := range opts.Artifacts {
+		for _, blob := range a.Blobs {
+			artifactBlobSizes[blob.Digest] = blob.Size
+		}
+		artifactBlobSizes[a.Descriptor().Digest] = int64(len(a.Manifest))
+	}
+
+	for digest, size := range artifactBlobSizes {
+		if _, ok := blobSizes[digest]; !ok && !skip.Has(digest.String()) {
+			estimate.ArtifactsSize += size
+		}
+	}
+
+	for _, m := range opts.Manifests {
+		estimate.ArtifactsSize += int64(len(m.Data))
+	}
+
+	estimate.TotalSize += estimate.ArtifactsSize
+
+	return &estimate, nil
+}
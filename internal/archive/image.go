@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Image returns an image (or artifact) in the archive, given its manifest
+// descriptor.
+func (a *Archive) Image(desc v1.Descriptor) (v1.Image, error) {
+	raw, err := a.ReadBlob(desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", desc.Digest, err)
+	}
+
+	var manifest v1.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", desc.Digest, err)
+	}
+
+	return partial.CompressedToImage(&archiveImage{
+		archive:   a,
+		mediaType: desc.MediaType,
+		raw:       raw,
+		manifest:  &manifest,
+	})
+}
+
+// ImageIndex returns an image index in the archive, given its descriptor.
+func (a *Archive) ImageIndex(desc v1.Descriptor) (v1.ImageIndex, error) {
+	raw, err := a.ReadBlob(desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index %s: %w", desc.Digest, err)
+	}
+
+	var index v1.IndexManifest
+	if err := json.Unmarshal(raw, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse index %s: %w", desc.Digest, err)
+	}
+
+	return &archiveIndex{
+		archive: a,
+		desc:    desc,
+		raw:     raw,
+		index:   &index,
+	}, nil
+}
+
+// archiveImage implements partial.CompressedImageCore for an image in an archive.
+type archiveImage struct {
+	archive   *Archive
+	mediaType types.MediaType
+	raw       []byte
+	manifest  *v1.Manifest
+}
+
+func (i *archiveImage) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+func (i *archiveImage) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+func (i *archiveImage) RawConfigFile() ([]byte, error) {
+	return i.archive.ReadBlob(i.manifest.Config.Digest)
+}
+
+func (i *archiveImage) LayerByDigest(digest v1.Hash) (partial.CompressedLayer, error) {
+	if digest == i.manifest.Config.Digest {
+		return &archiveBlob{archive: i.archive, desc: i.manifest.Config}, nil
+	}
+
+	for _, desc := range i.manifest.Layers {
+		if desc.Digest == digest {
+			return &archiveBlob{archive: i.archive, desc: desc}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("layer %s not found in manifest", digest)
+}
+
+// archiveBlob implements partial.CompressedLayer for a blob in an archive.
+type archiveBlob struct {
+	archive *Archive
+	desc    v1.Descriptor
+}
+
+func (b *archiveBlob) Digest() (v1.Hash, error) {
+	return b.desc.Digest, nil
+}
+
+func (b *archiveBlob) Compressed() (io.ReadCloser, error) {
+	return b.archive.Blob(b.desc.Digest)
+}
+
+func (b *archiveBlob) Size() (int64, error) {
+	return b.desc.Size, nil
+}
+
+func (b *archiveBlob) MediaType() (types.MediaType, error) {
+	return b.desc.MediaType, nil
+}
+
+// archiveIndex implements v1.ImageIndex for an image index in an archive.
+type archiveIndex struct {
+	archive *Archive
+	desc    v1.Descriptor
+	raw     []byte
+	index   *v1.IndexManifest
+}
+
+func (i *archiveIndex) MediaType() (types.MediaType, error) {
+	return i.desc.MediaType, nil
+}
+
+func (i *archiveIndex) Digest() (v1.Hash, error) {
+	return i.desc.Digest, nil
+}
+
+func (i *archiveIndex) Size() (int64, error) {
+	return int64(len(i.raw)), nil
+}
+
+func (i *archiveIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.index, nil
+}
+
+func (i *archiveIndex) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+func (i *archiveIndex) Image(digest v1.Hash) (v1.Image, error) {
+	desc, err := i.child(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.archive.Image(desc)
+}
+
+func (i *archiveIndex) ImageIndex(digest v1.Hash) (v1.ImageIndex, error) {
+	desc, err := i.child(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.archive.ImageIndex(desc)
+}
+
+func (i *archiveIndex) child(digest v1.Hash) (v1.Descriptor, error) {
+	for _, desc := range i.index.Manifests {
+		if desc.Digest == digest {
+			return desc, nil
+		}
+	}
+
+	return v1.Descriptor{}, fmt.Errorf("manifest %s not found in index", digest)
+}
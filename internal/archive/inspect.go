@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// ImageInfo describes an image (or artifact) in an archive.
+type ImageInfo struct {
+	// RefName is the reference name of the image (eg. "docker.io/library/nginx:1.25").
+	RefName string `json:"refName"`
+	// Digest is the digest of the image manifest (or index).
+	Digest v1.Hash `json:"digest"`
+	// MediaType is the media type of the image manifest (or index).
+	MediaType types.MediaType `json:"mediaType"`
+	// ArtifactType is the type of an artifact (eg. a Helm chart).
+	ArtifactType string `json:"artifactType,omitempty"`
+	// Platforms are the platforms the image is available for.
+	Platforms []string `json:"platforms,omitempty"`
+	// Layers is the number of unique layers in the image (across all platforms).
+	Layers int `json:"layers"`
+	// Size is the total size of the unique blobs in the image, including its
+	// manifests and configs.
+	Size int64 `json:"size"`
+}
+
+// Inspect describes each of the images (and artifacts) in the archive's index,
+// in index order.
+func (a *Archive) Inspect() ([]ImageInfo, error) {
+	readBlob := func(desc v1.Descriptor) ([]byte, error) {
+		return a.ReadBlob(desc.Digest)
+	}
+
+	var images []ImageInfo
+	for _, desc := range a.index.Manifests {
+		info := ImageInfo{
+			RefName:      desc.Annotations[AnnotationRefName],
+			Digest:       desc.Digest,
+			MediaType:    desc.MediaType,
+			ArtifactType: desc.ArtifactType,
+		}
+
+		platforms := sets.NewString()
+		layers := sets.NewString()
+
+		err := walkDescriptors([]v1.Descriptor{desc}, readBlob, func(desc v1.Descriptor) error {
+			info.Size += desc.Size
+
+			if !desc.MediaType.IsIndex() && !desc.MediaType.IsImage() {
+				return nil
+			}
+
+			if !a.HasBlob(desc.Digest) {
+				return nil
+			}
+
+			raw, err := a.ReadBlob(desc.Digest)
+			if err != nil {
+				return err
+			}
+
+			if desc.MediaType.IsIndex() {
+				var index v1.IndexManifest
+				if err := json.Unmarshal(raw, &index); err != nil {
+					return fmt.Errorf("failed to parse index %s: %w", desc.Digest, err)
+				}
+
+				for _, child := range index.Manifests {
+					if p := child.Platform; p != nil && p.OS != "unknown" {
+						platforms.Insert(p.String())
+					}
+				}
+
+				return nil
+			}
+
+			var manifest v1.Manifest
+			if err := json.Unmarshal(raw, &manifest); err != nil {
+				return fmt.Errorf("failed to parse manifest %s: %w", desc.Digest, err)
+			}
+
+			for _, layer := range manifest.Layers {
+				layers.Insert(layer.Digest.String())
+			}
+
+			// Single platform images only record their platform in their config.
+			if desc.Digest == info.Digest && manifest.Config.MediaType.IsConfig() {
+				p, err := a.configPlatform(manifest.Config.Digest)
+				if err != nil {
+					return err
+				}
+
+				if p != nil {
+					platforms.Insert(p.String())
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect %s: %w", desc.Digest, err)
+		}
+
+		info.Platforms = platforms.List()
+		info.Layers = layers.Len()
+
+		images = append(images, info)
+	}
+
+	return images, nil
+}
+
+// configPlatform returns the platform recorded in an image config, if it's
+// present in the archive.
+func (a *Archive) configPlatform(digest v1.Hash) (*v1.Platform, error) {
+	if !a.HasBlob(digest) {
+		return nil, nil
+	}
+
+	raw, err := a.ReadBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var config v1.ConfigFile
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", digest, err)
+	}
+
+	if config.OS == "" {
+		return nil, nil
+	}
+
+	return config.Platform(), nil
+}
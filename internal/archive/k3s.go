@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpeckett/airgapify/internal/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// AnnotationContainerdImageName is the annotation containerd uses to name an
+// image when importing an OCI archive.
+const AnnotationContainerdImageName = "io.containerd.image.name"
+
+// containerdImageName returns the fully qualified image name that containerd
+// (and so k3s and RKE2) uses for an image reference, eg.
+// "docker.io/library/nginx:latest" (or "docker.io/library/nginx:1.25@sha256:..."
+// for a reference by both tag and digest).
+func containerdImageName(ref name.Reference) string {
+	registry := ref.Context().RegistryStr()
+	if registry == name.DefaultRegistry {
+		registry = "docker.io"
+	}
+
+	repo := registry + "/" + ref.Context().RepositoryStr()
+	if digest, ok := ref.(name.Digest); ok {
+		if tag, ok := util.ReferenceTag(ref); ok {
+			return repo + ":" + tag.TagStr() + "@" + digest.DigestStr()
+		}
+
+		return repo + "@" + digest.DigestStr()
+	}
+
+	return repo + ":" + ref.Identifier()
+}
+
+// imageListPath returns the path of the image list written alongside a k3s
+// archive, eg. "k3s-airgap-images.txt" for "k3s-airgap-images.tar.zst".
+func imageListPath(outputPath string) string {
+	base := filepath.Base(outputPath)
+	if i := strings.Index(base, ".tar"); i > 0 {
+		base = base[:i]
+	} else {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+
+	return filepath.Join(filepath.Dir(outputPath), base+".txt")
+}
+
+// writeImageList writes the list of images in a k3s archive (one per line, in
+// the same form as the k3s and RKE2 release image lists).
+func writeImageList(listPath string, images sets.String, opts CreateOptions) error {
+	names := sets.NewString()
+	for _, image := range images.UnsortedList() {
+		ref, err := opts.Registries.ParseReference(image)
+		if err != nil {
+			return fmt.Errorf("failed to parse image reference %q: %w", image, err)
+		}
+
+		names.Insert(containerdImageName(ref))
+	}
+
+	var sb strings.Builder
+	for _, name := range names.List() {
+		sb.WriteString(name + "\n")
+	}
+
+	return os.WriteFile(listPath, []byte(sb.String()), 0o644)
+}
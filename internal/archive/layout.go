@@ -0,0 +1,418 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dpeckett/airgapify/internal/artifact"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const ociLayoutFile = `{"imageLayoutVersion":"1.0.0"}`
+
+// imageWriter appends images to an image archive.
+type imageWriter interface {
+	AppendImage(ref name.Reference, img v1.Image, platform *v1.Platform) error
+	// AppendArtifact appends a non-image OCI artifact (eg. a Helm chart).
+	AppendArtifact(a *artifact.Artifact) error
+	// WriteFile writes an additional file (eg. an embedded manifest) to the archive.
+	WriteFile(name string, data []byte) error
+	// Close finalizes the archive (eg. writing the index).
+	Close() error
+}
+
+// discarder is implemented by writers that hold resources (eg. temporary
+// files) that need to be released if writing fails.
+type discarder interface {
+	discard()
+}
+
+// discard abandons a writer without finalizing it, so that a partially
+// written archive has no index (or end-of-archive marker) and can't be
+// mistaken for a complete one.
+func discard(w any) {
+	if d, ok := w.(discarder); ok {
+		d.discard()
+	}
+}
+
+// layoutWriter writes blobs and index entries to an OCI image layout.
+type layoutWriter interface {
+	// WriteBlob writes a blob to the layout, unless it has already been written.
+	WriteBlob(digest v1.Hash, size int64, r io.Reader) error
+	// AppendDescriptor adds an entry to the index, replacing any existing entry
+	// with the same reference name.
+	AppendDescriptor(desc v1.Descriptor)
+	// SetAnnotation sets an annotation on the index.
+	SetAnnotation(key, value string)
+	// WriteFile writes a file that isn't part of the image layout itself.
+	WriteFile(name string, data []byte) error
+	// Close writes the index and finalizes the layout.
+	Close() error
+}
+
+// ociImageWriter appends images to an OCI image layout.
+type ociImageWriter struct {
+	lw layoutWriter
+	// skip is the set of blobs that should not be written (eg. because they
+	// are already present in a base archive).
+	skip sets.String
+	// containerdNames adds containerd image name annotations to index entries.
+	containerdNames bool
+}
+
+func newOCIImageWriter(lw layoutWriter, skip sets.String) *ociImageWriter {
+	if skip == nil {
+		skip = sets.NewString()
+	}
+
+	return &ociImageWriter{lw: lw, skip: skip}
+}
+
+func (w *ociImageWriter) AppendImage(ref name.Reference, img v1.Image, platform *v1.Platform) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+
+		if w.skip.Has(digest.String()) {
+			continue
+		}
+
+		size, err := layer.Size()
+		if err != nil {
+			return err
+		}
+
+		rc, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+
+		err = w.lw.WriteBlob(digest, size, rc)
+		_ = rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write layer %s: %w", digest, err)
+		}
+	}
+
+	configName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+
+	if err := w.writeBlobBytes(configName, rawConfig); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+
+	if err := w.writeBlobBytes(digest, rawManifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return err
+	}
+
+	annotations := refAnnotations(ref)
+	if w.containerdNames {
+		annotations[AnnotationContainerdImageName] = containerdImageName(ref)
+	}
+
+	w.lw.AppendDescriptor(v1.Descriptor{
+		MediaType:   mediaType,
+		Size:        int64(len(rawManifest)),
+		Digest:      digest,
+		Annotations: annotations,
+		Platform:    platform,
+	})
+
+	return nil
+}
+
+func (w *ociImageWriter) AppendArtifact(a *artifact.Artifact) error {
+	for _, blob := range a.Blobs {
+		if w.skip.Has(blob.Digest.String()) {
+			continue
+		}
+
+		rc, err := blob.Open()
+		if err != nil {
+			return err
+		}
+
+		err = w.lw.WriteBlob(blob.Digest, blob.Size, rc)
+		_ = rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write blob %s: %w", blob.Digest, err)
+		}
+	}
+
+	desc := a.Descriptor()
+	if err := w.writeBlobBytes(desc.Digest, a.Manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	desc.Annotations = map[string]string{
+		AnnotationRefName: a.RefName,
+	}
+
+	w.lw.AppendDescriptor(desc)
+
+	return nil
+}
+
+func (w *ociImageWriter) WriteFile(name string, data []byte) error {
+	return w.lw.WriteFile(name, data)
+}
+
+func (w *ociImageWriter) Close() error {
+	return w.lw.Close()
+}
+
+func (w *ociImageWriter) discard() {
+	discard(w.lw)
+}
+
+func (w *ociImageWriter) writeBlobBytes(digest v1.Hash, data []byte) error {
+	if w.skip.Has(digest.String()) {
+		return nil
+	}
+
+	return w.lw.WriteBlob(digest, int64(len(data)), bytes.NewReader(data))
+}
+
+// dirLayoutWriter writes an OCI image layout to a directory. If the directory
+// already contains a layout, blobs that already exist are not rewritten and
+// the existing index is extended.
+type dirLayoutWriter struct {
+	dir   string
+	index v1.IndexManifest
+}
+
+func newDirLayoutWriter(dir string) (*dirLayoutWriter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create image layout: %w", err)
+	}
+
+	w := &dirLayoutWriter{
+		dir:   dir,
+		index: emptyIndex(),
+	}
+
+	rawIndex, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read existing index: %w", err)
+	} else if err == nil {
+		if err := json.Unmarshal(rawIndex, &w.index); err != nil {
+			return nil, fmt.Errorf("failed to parse existing index: %w", err)
+		}
+	}
+
+	return w, nil
+}
+
+func (w *dirLayoutWriter) WriteBlob(digest v1.Hash, size int64, r io.Reader) error {
+	dir := filepath.Join(w.dir, "blobs", digest.Algorithm)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, digest.Hex)
+	if fi, err := os.Stat(path); err == nil && fi.Size() == size {
+		return nil
+	}
+
+	// Write to a temporary file first so that a partially written blob is
+	// never mistaken for a complete one.
+	f, err := os.CreateTemp(dir, digest.Hex+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if n != size {
+		return fmt.Errorf("expected blob size %d, but wrote %d", size, n)
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (w *dirLayoutWriter) AppendDescriptor(desc v1.Descriptor) {
+	appendDescriptor(&w.index, desc)
+}
+
+func (w *dirLayoutWriter) SetAnnotation(key, value string) {
+	setIndexAnnotation(&w.index, key, value)
+}
+
+func (w *dirLayoutWriter) WriteFile(name string, data []byte) error {
+	path := filepath.Join(w.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
+
+func (w *dirLayoutWriter) Close() error {
+	if err := os.WriteFile(filepath.Join(w.dir, "oci-layout"), []byte(ociLayoutFile), 0o644); err != nil {
+		return err
+	}
+
+	rawIndex, err := marshalIndex(&w.index)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(w.dir, "index.json"), rawIndex, 0o644)
+}
+
+func emptyIndex() v1.IndexManifest {
+	return v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     []v1.Descriptor{},
+	}
+}
+
+// appendDescriptor adds a descriptor to an index, replacing any existing
+// descriptor with the same reference name.
+func appendDescriptor(index *v1.IndexManifest, desc v1.Descriptor) {
+	if refName, ok := desc.Annotations[AnnotationRefName]; ok {
+		for i, existing := range index.Manifests {
+			if existing.Annotations[AnnotationRefName] == refName {
+				index.Manifests[i] = desc
+				return
+			}
+		}
+	}
+
+	index.Manifests = append(index.Manifests, desc)
+}
+
+func setIndexAnnotation(index *v1.IndexManifest, key, value string) {
+	if index.Annotations == nil {
+		index.Annotations = make(map[string]string)
+	}
+
+	index.Annotations[key] = value
+}
+
+// marshalIndex serializes an index, with its entries sorted by reference name
+// (and then digest) so that the index doesn't depend on the order images were
+// added in.
+func marshalIndex(index *v1.IndexManifest) ([]byte, error) {
+	sort.SliceStable(index.Manifests, func(i, j int) bool {
+		a, b := index.Manifests[i], index.Manifests[j]
+		if refA, refB := a.Annotations[AnnotationRefName], b.Annotations[AnnotationRefName]; refA != refB {
+			return refA < refB
+		}
+
+		return a.Digest.String() < b.Digest.String()
+	})
+
+	return json.MarshalIndent(index, "", "   ")
+}
+
+// stagedLayoutWriter writes an OCI image layout to a temporary directory, and
+// then archives the directory on close.
+type stagedLayoutWriter struct {
+	*dirLayoutWriter
+	dst io.Writer
+}
+
+func newStagedLayoutWriter(dst io.Writer) (*stagedLayoutWriter, error) {
+	layoutDir, err := os.MkdirTemp("", "airgapify-archive-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary archive directory: %w", err)
+	}
+
+	dw, err := newDirLayoutWriter(layoutDir)
+	if err != nil {
+		_ = os.RemoveAll(layoutDir)
+		return nil, err
+	}
+
+	return &stagedLayoutWriter{
+		dirLayoutWriter: dw,
+		dst:             dst,
+	}, nil
+}
+
+func (w *stagedLayoutWriter) Close() error {
+	defer os.RemoveAll(w.dir)
+
+	if err := w.dirLayoutWriter.Close(); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w.dst)
+	if err := writeTarFS(tw, os.DirFS(w.dir)); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func (w *stagedLayoutWriter) discard() {
+	_ = os.RemoveAll(w.dir)
+}
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+)
+
+// ManifestsDir is the directory in an archive that embedded Kubernetes
+// manifests are written to.
+const ManifestsDir = "manifests"
+
+// ManifestFile is a Kubernetes manifest file embedded in an archive.
+type ManifestFile struct {
+	// Name is the name of the file within ManifestsDir.
+	Name string
+	// Data is the contents of the file.
+	Data []byte
+}
+
+func writeManifests(iw imageWriter, manifests []ManifestFile) error {
+	for _, m := range manifests {
+		if m.Name == "" || path.Base(m.Name) != m.Name {
+			return fmt.Errorf("invalid manifest file name %q", m.Name)
+		}
+
+		if err := iw.WriteFile(path.Join(ManifestsDir, m.Name), m.Data); err != nil {
+			return fmt.Errorf("failed to write manifest %q: %w", m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// copyManifests copies the Kubernetes manifests embedded in an archive (if
+// any) to a layout writer.
+func copyManifests(lw layoutWriter, a *Archive) error {
+	manifests, err := a.manifests()
+	if err != nil {
+		return fmt.Errorf("failed to read embedded manifests: %w", err)
+	}
+
+	for _, m := range manifests {
+		if err := lw.WriteFile(path.Join(ManifestsDir, m.Name), m.Data); err != nil {
+			return fmt.Errorf("failed to write manifest %q: %w", m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ExtractManifests returns the Kubernetes manifests embedded in an archive,
+// ordered by name.
+func ExtractManifests(archivePath string) ([]ManifestFile, error) {
+	a, err := openFS(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	manifests, err := a.manifests()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(manifests) == 0 {
+		return nil, errors.New("archive does not contain any manifests")
+	}
+
+	return manifests, nil
+}
+
+// manifests returns the Kubernetes manifests embedded in the archive (if any),
+// ordered by name.
+func (a *Archive) manifests() ([]ManifestFile, error) {
+	entries, err := fs.ReadDir(a.fsys, ManifestsDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var manifests []ManifestFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		data, err := fs.ReadFile(a.fsys, path.Join(ManifestsDir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest %q: %w", e.Name(), err)
+		}
+
+		manifests = append(manifests, ManifestFile{Name: e.Name(), Data: data})
+	}
+
+	return manifests, nil
+}
@@ -0,0 +1,345 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/dpeckett/airgapify/internal/compression"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ConflictPolicy determines how conflicts are resolved when merging archives.
+type ConflictPolicy string
+
+const (
+	// ConflictFail fails the merge if there are any conflicts.
+	ConflictFail ConflictPolicy = "fail"
+	// ConflictFirst keeps the image from the first archive it appears in.
+	ConflictFirst ConflictPolicy = "first"
+	// ConflictLast keeps the image from the last archive it appears in.
+	ConflictLast ConflictPolicy = "last"
+)
+
+// MergeOptions are options for merging archives.
+type MergeOptions struct {
+	// Format is the output format of the archive (FormatOCI or FormatOCIDir).
+	Format Format
+	// Compression is the compression to apply to the archive. If nil, it's
+	// inferred from the output file extension.
+	Compression *compression.Options
+	// Conflicts is how to resolve reference names that point to different
+	// digests in different archives. Defaults to ConflictFail.
+	Conflicts ConflictPolicy
+}
+
+// MergeConflict is a reference name that points to different digests in
+// different archives.
+type MergeConflict struct {
+	RefName string `json:"refName"`
+	// Digests are the digest of the image in each archive (in order), or
+	// nil if the archive doesn't contain it.
+	Digests []*v1.Hash `json:"digests"`
+	// Resolved is the digest that was kept (unless the merge failed).
+	Resolved *v1.Hash `json:"resolved,omitempty"`
+}
+
+// Merge combines a set of archives into a single archive at outputPath. Blobs
+// are deduplicated by digest, and index entries are combined by reference
+// name. Conflicts (reference names that point to different digests) are
+// resolved according to opts.Conflicts, and returned. Embedded manifests and
+// index annotations are carried over, embedded manifests with the same name
+// but different contents (and annotations with different values) are resolved
+// according to opts.Conflicts too.
+func Merge(inputPaths []string, outputPath string, opts MergeOptions) (conflicts []MergeConflict, err error) {
+	if opts.Conflicts == "" {
+		opts.Conflicts = ConflictFail
+	}
+
+	switch opts.Conflicts {
+	case ConflictFail, ConflictFirst, ConflictLast:
+	default:
+		return nil, fmt.Errorf("unsupported conflict policy %q", opts.Conflicts)
+	}
+
+	var inputs []*Archive
+	defer func() {
+		for _, a := range inputs {
+			_ = a.Close()
+		}
+	}()
+
+	for _, inputPath := range inputPaths {
+		a, err := Open(inputPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", inputPath, err)
+		}
+		inputs = append(inputs, a)
+
+		if _, ok := a.Index().Annotations[AnnotationBaseDigest]; ok {
+			return nil, fmt.Errorf("%s is an incremental archive, apply it to its base first", inputPath)
+		}
+	}
+
+	// Index entries by reference name (or digest, for entries without one),
+	// for each input.
+	var keys []string
+	descs := make(map[string][]*v1.Descriptor)
+	for i, a := range inputs {
+		for _, desc := range a.Index().Manifests {
+			key, ok := desc.Annotations[AnnotationRefName]
+			if !ok {
+				key = desc.Digest.String()
+			}
+
+			if _, ok := descs[key]; !ok {
+				keys = append(keys, key)
+				descs[key] = make([]*v1.Descriptor, len(inputs))
+			}
+
+			desc := desc
+			descs[key][i] = &desc
+		}
+	}
+
+	var merged []v1.Descriptor
+	for _, key := range keys {
+		var chosen *v1.Descriptor
+		conflict := false
+		for _, desc := range descs[key] {
+			if desc == nil {
+				continue
+			}
+
+			if chosen != nil && desc.Digest != chosen.Digest {
+				conflict = true
+			}
+
+			if chosen == nil || opts.Conflicts == ConflictLast {
+				chosen = desc
+			}
+		}
+
+		if conflict {
+			c := MergeConflict{RefName: key}
+			for _, desc := range descs[key] {
+				if desc != nil {
+					digest := desc.Digest
+					c.Digests = append(c.Digests, &digest)
+				} else {
+					c.Digests = append(c.Digests, nil)
+				}
+			}
+
+			if opts.Conflicts != ConflictFail {
+				digest := chosen.Digest
+				c.Resolved = &digest
+			}
+
+			conflicts = append(conflicts, c)
+		}
+
+		merged = append(merged, *chosen)
+	}
+
+	if len(conflicts) > 0 && opts.Conflicts == ConflictFail {
+		var refNames []string
+		for _, c := range conflicts {
+			refNames = append(refNames, c.RefName)
+		}
+
+		return conflicts, fmt.Errorf("conflicting images: %s", strings.Join(refNames, ", "))
+	}
+
+	manifests, err := mergeManifests(inputs, inputPaths, opts.Conflicts)
+	if err != nil {
+		return conflicts, err
+	}
+
+	annotations, err := mergeAnnotations(inputs, inputPaths, opts.Conflicts)
+	if err != nil {
+		return conflicts, err
+	}
+
+	lw, closeOutput, err := newOutputLayoutWriter(outputPath, opts.Format, opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := closeOutput(err != nil); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	if err := copyImages(lw, inputs, merged); err != nil {
+		return conflicts, err
+	}
+
+	for key, value := range annotations {
+		lw.SetAnnotation(key, value)
+	}
+
+	for _, m := range manifests {
+		if err := lw.WriteFile(path.Join(ManifestsDir, m.Name), m.Data); err != nil {
+			return conflicts, fmt.Errorf("failed to write manifest %q: %w", m.Name, err)
+		}
+	}
+
+	slog.Info("Writing image archive", "path", outputPath)
+
+	if err := lw.Close(); err != nil {
+		return conflicts, err
+	}
+
+	return conflicts, nil
+}
+
+// mergeManifests combines the Kubernetes manifests embedded in a set of
+// archives, ordered by name. Files with the same name but different contents
+// are resolved according to the conflict policy.
+func mergeManifests(inputs []*Archive, inputPaths []string, policy ConflictPolicy) ([]ManifestFile, error) {
+	var names []string
+	files := make(map[string][]byte)
+	for i, a := range inputs {
+		manifests, err := a.manifests()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read embedded manifests of %s: %w", inputPaths[i], err)
+		}
+
+		for _, m := range manifests {
+			existing, ok := files[m.Name]
+			if !ok {
+				names = append(names, m.Name)
+				files[m.Name] = m.Data
+				continue
+			}
+
+			if bytes.Equal(existing, m.Data) {
+				continue
+			}
+
+			switch policy {
+			case ConflictFail:
+				return nil, fmt.Errorf("conflicting embedded manifest %q in %s", m.Name, inputPaths[i])
+			case ConflictLast:
+				files[m.Name] = m.Data
+			}
+
+			slog.Warn("Conflicting embedded manifest", "name", m.Name, "archive", inputPaths[i], "policy", policy)
+		}
+	}
+
+	sort.Strings(names)
+
+	var manifests []ManifestFile
+	for _, name := range names {
+		manifests = append(manifests, ManifestFile{Name: name, Data: files[name]})
+	}
+
+	return manifests, nil
+}
+
+// mergeAnnotations combines the index annotations of a set of archives.
+// Annotations with different values are resolved according to the conflict
+// policy. The compression annotation is skipped, as it describes the output.
+func mergeAnnotations(inputs []*Archive, inputPaths []string, policy ConflictPolicy) (map[string]string, error) {
+	annotations := make(map[string]string)
+	for i, a := range inputs {
+		for key, value := range a.Index().Annotations {
+			if key == AnnotationCompression {
+				continue
+			}
+
+			existing, ok := annotations[key]
+			if !ok {
+				annotations[key] = value
+				continue
+			}
+
+			if existing == value {
+				continue
+			}
+
+			switch policy {
+			case ConflictFail:
+				return nil, fmt.Errorf("conflicting index annotation %q in %s", key, inputPaths[i])
+			case ConflictLast:
+				annotations[key] = value
+			}
+
+			slog.Warn("Conflicting index annotation", "key", key, "archive", inputPaths[i], "policy", policy)
+		}
+	}
+
+	return annotations, nil
+}
+
+// copyImages copies a set of images (and every blob they reference) from a
+// set of archives into a layout. Blobs are taken from the first archive that
+// has them.
+func copyImages(lw layoutWriter, sources []*Archive, descs []v1.Descriptor) error {
+	source := func(digest v1.Hash) *Archive {
+		for _, a := range sources {
+			if a.HasBlob(digest) {
+				return a
+			}
+		}
+
+		return nil
+	}
+
+	readBlob := func(desc v1.Descriptor) ([]byte, error) {
+		a := source(desc.Digest)
+		if a == nil {
+			return nil, os.ErrNotExist
+		}
+
+		return a.ReadBlob(desc.Digest)
+	}
+
+	var missing []string
+	err := walkDescriptors(descs, readBlob, func(desc v1.Descriptor) error {
+		a := source(desc.Digest)
+		if a == nil {
+			missing = append(missing, desc.Digest.String())
+			return nil
+		}
+
+		return copyBlob(lw, a, desc.Digest)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("archive is incomplete, missing blobs: %s", strings.Join(missing, ", "))
+	}
+
+	for _, desc := range descs {
+		lw.AppendDescriptor(desc)
+	}
+
+	return nil
+}
@@ -0,0 +1,378 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/dpeckett/airgapify/internal/volume"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/uncompr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Archive is a read-only view of an OCI image layout, stored either as a
+// directory or as a (possibly compressed, or split into volumes) tar archive.
+type Archive struct {
+	fsys     fs.FS
+	rawIndex []byte
+	index    *v1.IndexManifest
+	closers  []func() error
+}
+
+// Open opens an image archive. The path may be an OCI image layout directory,
+// a tar archive (optionally compressed), or a volume manifest.
+func Open(archivePath string) (*Archive, error) {
+	a, err := openFS(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	a.rawIndex, err = fs.ReadFile(a.fsys, "index.json")
+	if err != nil {
+		_ = a.Close()
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	if err := json.Unmarshal(a.rawIndex, &a.index); err != nil {
+		_ = a.Close()
+		return nil, fmt.Errorf("failed to parse index: %w", err)
+	}
+
+	return a, nil
+}
+
+// openFS opens the filesystem of an archive, without reading its index (so it
+// can also be used with docker archives).
+func openFS(archivePath string) (a *Archive, err error) {
+	a = &Archive{}
+	defer func() {
+		if err != nil {
+			_ = a.Close()
+		}
+	}()
+
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+
+	if fi.IsDir() {
+		a.fsys = os.DirFS(archivePath)
+	} else {
+		var ra io.ReaderAt
+		var size int64
+		if volume.IsManifest(archivePath) {
+			vr, err := volume.Open(archivePath)
+			if err != nil {
+				return nil, err
+			}
+			a.closers = append(a.closers, vr.Close)
+
+			ra, size = vr, vr.Size()
+		} else {
+			f, err := os.Open(archivePath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open archive: %w", err)
+			}
+			a.closers = append(a.closers, f.Close)
+
+			ra, size = f, fi.Size()
+		}
+
+		if !isTar(ra) {
+			// Compressed archives can't be read at random offsets, so they need
+			// to be decompressed to a temporary file first.
+			if ra, err = a.decompress(io.NewSectionReader(ra, 0, size)); err != nil {
+				return nil, fmt.Errorf("failed to decompress archive: %w", err)
+			}
+		}
+
+		a.fsys, err = tarfs.Open(ra)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+	}
+
+	return a, nil
+}
+
+// Close releases any resources held by the archive.
+func (a *Archive) Close() error {
+	var errs []error
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		errs = append(errs, a.closers[i]())
+	}
+	a.closers = nil
+
+	return errors.Join(errs...)
+}
+
+// Index returns the top-level image index of the archive.
+func (a *Archive) Index() *v1.IndexManifest {
+	return a.index
+}
+
+// Digest returns the digest of the archive's index.json, which identifies the
+// set of images it contains.
+func (a *Archive) Digest() v1.Hash {
+	sum := sha256.Sum256(a.rawIndex)
+	return v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}
+}
+
+// HasBlob returns whether the archive contains a blob.
+func (a *Archive) HasBlob(digest v1.Hash) bool {
+	_, err := a.BlobSize(digest)
+	return err == nil
+}
+
+// BlobSize returns the size of a blob in the archive.
+func (a *Archive) BlobSize(digest v1.Hash) (int64, error) {
+	fi, err := fs.Stat(a.fsys, blobPath(digest))
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// Blob opens a blob in the archive.
+func (a *Archive) Blob(digest v1.Hash) (io.ReadCloser, error) {
+	return a.fsys.Open(blobPath(digest))
+}
+
+// BlobReader opens a blob in the archive for random access (eg. for serving
+// range requests).
+func (a *Archive) BlobReader(digest v1.Hash) (io.ReadSeekCloser, error) {
+	f, err := a.fsys.Open(blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+
+	if rs, ok := f.(io.ReadSeekCloser); ok {
+		return rs, nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &seekingReader{
+		open: func() (io.ReadCloser, error) {
+			return a.fsys.Open(blobPath(digest))
+		},
+		rc:   f,
+		size: fi.Size(),
+	}, nil
+}
+
+// ReadBlob reads the contents of a (small) blob in the archive, such as a
+// manifest or config.
+func (a *Archive) ReadBlob(digest v1.Hash) ([]byte, error) {
+	return fs.ReadFile(a.fsys, blobPath(digest))
+}
+
+// Blobs returns the digests of every blob in the archive, in sorted order.
+func (a *Archive) Blobs() ([]v1.Hash, error) {
+	algorithms, err := fs.ReadDir(a.fsys, "blobs")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var blobs []v1.Hash
+	for _, alg := range algorithms {
+		if !alg.IsDir() {
+			continue
+		}
+
+		entries, err := fs.ReadDir(a.fsys, path.Join("blobs", alg.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+
+			blobs = append(blobs, v1.Hash{Algorithm: alg.Name(), Hex: e.Name()})
+		}
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].String() < blobs[j].String()
+	})
+
+	return blobs, nil
+}
+
+func (a *Archive) decompress(r io.Reader) (io.ReaderAt, error) {
+	dr, err := uncompr.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	f, err := os.CreateTemp("", "airgapify-archive-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	a.closers = append(a.closers, func() error {
+		return errors.Join(f.Close(), os.Remove(f.Name()))
+	})
+
+	if _, err := io.Copy(f, dr); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func blobPath(digest v1.Hash) string {
+	return path.Join("blobs", digest.Algorithm, digest.Hex)
+}
+
+// isTar returns whether a file looks like an (uncompressed) tar archive, by
+// checking for the ustar magic in the first header.
+func isTar(ra io.ReaderAt) bool {
+	magic := make([]byte, 5)
+	if _, err := ra.ReadAt(magic, 257); err != nil {
+		return false
+	}
+
+	return bytes.Equal(magic, []byte("ustar"))
+}
+
+// seekingReader adds seeking to a file that can only be read sequentially
+// (such as a file in a tar archive). Seeking forwards skips over data, and
+// seeking backwards reopens the file.
+type seekingReader struct {
+	open func() (io.ReadCloser, error)
+	rc   io.ReadCloser
+	// offset is the current offset of rc, and pos the offset to read from next.
+	offset, pos int64
+	size        int64
+}
+
+func (r *seekingReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.rc == nil || r.pos < r.offset {
+		if r.rc != nil {
+			_ = r.rc.Close()
+			r.rc = nil
+		}
+
+		rc, err := r.open()
+		if err != nil {
+			return 0, err
+		}
+
+		r.rc, r.offset = rc, 0
+	}
+
+	if r.pos > r.offset {
+		n, err := io.CopyN(io.Discard, r.rc, r.pos-r.offset)
+		r.offset += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.rc.Read(p)
+	r.offset += int64(n)
+	r.pos = r.offset
+
+	return n, err
+}
+
+func (r *seekingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.pos = offset
+
+	return offset, nil
+}
+
+func (r *seekingReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+
+	return r.rc.Close()
+}
+
+// verifyingReader checks that the data read from a blob matches its digest.
+type verifyingReader struct {
+	r      io.Reader
+	digest v1.Hash
+	hasher hash.Hash
+}
+
+func newVerifyingReader(r io.Reader, digest v1.Hash) (io.Reader, error) {
+	if digest.Algorithm != "sha256" {
+		return nil, fmt.Errorf("unsupported digest algorithm %q", digest.Algorithm)
+	}
+
+	return &verifyingReader{r: r, digest: digest, hasher: sha256.New()}, nil
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	_, _ = r.hasher.Write(p[:n])
+
+	if errors.Is(err, io.EOF) {
+		if got := hex.EncodeToString(r.hasher.Sum(nil)); got != r.digest.Hex {
+			return n, fmt.Errorf("blob %s has unexpected digest sha256:%s", r.digest, got)
+		}
+	}
+
+	return n, err
+}
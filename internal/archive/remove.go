@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/dpeckett/airgapify/internal/compression"
+	"github.com/dpeckett/airgapify/internal/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// RemoveOptions are options for removing images from an archive.
+type RemoveOptions struct {
+	// Format is the output format of the archive (FormatOCI or FormatOCIDir).
+	Format Format
+	// Compression is the compression to apply to the archive. If nil, it's
+	// inferred from the output file extension.
+	Compression *compression.Options
+}
+
+// Remove writes a copy of an archive to outputPath, without the images that
+// match any of the given patterns. A pattern is either a digest, a shell glob
+// matched against reference names, as written or fully qualified (eg.
+// "*/library/nginx:*"), or an image reference (eg. "nginx:1.25"). Blobs that are no longer referenced by
+// any remaining image are dropped. Returns the removed index entries.
+func Remove(inputPath, outputPath string, patterns []string, opts RemoveOptions) (removed []v1.Descriptor, err error) {
+	a, err := Open(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer a.Close()
+
+	if _, ok := a.Index().Annotations[AnnotationBaseDigest]; ok {
+		return nil, fmt.Errorf("%s is an incremental archive, apply it to its base first", inputPath)
+	}
+
+	matched := make([]bool, len(patterns))
+	var kept []v1.Descriptor
+	for _, desc := range a.Index().Manifests {
+		remove := false
+		for i, pattern := range patterns {
+			ok, err := matchImage(pattern, desc)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				matched[i] = true
+				remove = true
+			}
+		}
+
+		if remove {
+			removed = append(removed, desc)
+		} else {
+			kept = append(kept, desc)
+		}
+	}
+
+	for i, pattern := range patterns {
+		if !matched[i] {
+			return nil, fmt.Errorf("no images match %q", pattern)
+		}
+	}
+
+	lw, closeOutput, err := newOutputLayoutWriter(outputPath, opts.Format, opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := closeOutput(err != nil); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	// Only blobs reachable from the remaining images are copied.
+	if err := copyImages(lw, []*Archive{a}, kept); err != nil {
+		return nil, err
+	}
+
+	if err := copyManifests(lw, a); err != nil {
+		return nil, err
+	}
+
+	for key, value := range a.Index().Annotations {
+		if key != AnnotationCompression {
+			lw.SetAnnotation(key, value)
+		}
+	}
+
+	slog.Info("Writing image archive", "path", outputPath)
+
+	if err := lw.Close(); err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// matchImage returns whether an index entry matches a pattern (see Remove).
+func matchImage(pattern string, desc v1.Descriptor) (bool, error) {
+	if h, err := v1.NewHash(pattern); err == nil {
+		return desc.Digest == h, nil
+	}
+
+	refName, ok := desc.Annotations[AnnotationRefName]
+	if !ok {
+		return false, nil
+	}
+
+	// Reference names are stored as written, eg. "nginx:1.25".
+	imageRef, err := name.ParseReference(refName)
+	if err != nil {
+		imageRef = nil
+	}
+
+	if strings.ContainsAny(pattern, "*?[") {
+		// Match both the reference name as written and its fully qualified
+		// form (eg. "index.docker.io/library/nginx:1.25").
+		names := []string{refName}
+		if imageRef != nil {
+			names = append(names, qualifiedName(imageRef))
+		}
+
+		for _, n := range names {
+			ok, err := path.Match(pattern, n)
+			if err != nil {
+				return false, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+
+			if ok {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	// Compare normalized references, so that eg. "nginx:1.25" matches
+	// "index.docker.io/library/nginx:1.25".
+	ref, err := name.ParseReference(pattern)
+	if err != nil {
+		return false, fmt.Errorf("invalid image reference %q: %w", pattern, err)
+	}
+
+	if imageRef == nil {
+		return refName == pattern, nil
+	}
+
+	if qualifiedName(ref) == qualifiedName(imageRef) {
+		return true, nil
+	}
+
+	// A tag also matches images referenced by the same tag and a digest.
+	if tag, ok := ref.(name.Tag); ok {
+		if imageTag, ok := util.ReferenceTag(imageRef); ok {
+			return tag.Name() == imageTag.Name(), nil
+		}
+	}
+
+	return false, nil
+}
+
+// qualifiedName returns the fully qualified name of a reference, keeping the
+// tag of tag@digest references (which name.Digest.Name drops).
+func qualifiedName(ref name.Reference) string {
+	if tag, ok := util.ReferenceTag(ref); ok {
+		return tag.Name() + "@" + ref.Identifier()
+	}
+
+	return ref.Name()
+}
@@ -0,0 +1,186 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// tarLayoutWriter streams an OCI image layout directly into a tar archive.
+// Blobs are written as they are fetched, and the index is written on close.
+type tarLayoutWriter struct {
+	tw    *tar.Writer
+	dirs  sets.String
+	blobs sets.String
+	index v1.IndexManifest
+}
+
+func newTarLayoutWriter(dst io.Writer) *tarLayoutWriter {
+	return &tarLayoutWriter{
+		tw:    tar.NewWriter(dst),
+		dirs:  sets.NewString(),
+		blobs: sets.NewString(),
+		index: emptyIndex(),
+	}
+}
+
+func (w *tarLayoutWriter) WriteBlob(digest v1.Hash, size int64, r io.Reader) error {
+	if w.blobs.Has(digest.String()) {
+		return nil
+	}
+
+	name := path.Join("blobs", digest.Algorithm, digest.Hex)
+	if err := w.writeDirs(path.Dir(name)); err != nil {
+		return err
+	}
+
+	if err := writeTarEntry(w.tw, name, size, r); err != nil {
+		return err
+	}
+
+	w.blobs.Insert(digest.String())
+
+	return nil
+}
+
+func (w *tarLayoutWriter) AppendDescriptor(desc v1.Descriptor) {
+	appendDescriptor(&w.index, desc)
+}
+
+func (w *tarLayoutWriter) SetAnnotation(key, value string) {
+	setIndexAnnotation(&w.index, key, value)
+}
+
+func (w *tarLayoutWriter) WriteFile(name string, data []byte) error {
+	if err := w.writeDirs(path.Dir(name)); err != nil {
+		return err
+	}
+
+	return w.writeFile(name, data)
+}
+
+func (w *tarLayoutWriter) Close() error {
+	if err := w.writeFile("oci-layout", []byte(ociLayoutFile)); err != nil {
+		return err
+	}
+
+	rawIndex, err := marshalIndex(&w.index)
+	if err != nil {
+		return err
+	}
+
+	if err := w.writeFile("index.json", rawIndex); err != nil {
+		return err
+	}
+
+	return w.tw.Close()
+}
+
+func (w *tarLayoutWriter) writeFile(name string, data []byte) error {
+	return writeTarEntry(w.tw, name, int64(len(data)), bytes.NewReader(data))
+}
+
+// writeDirs writes entries for the given directory and any of its parents
+// that have not already been written.
+func (w *tarLayoutWriter) writeDirs(dir string) error {
+	if dir == "." || w.dirs.Has(dir) {
+		return nil
+	}
+
+	if err := w.writeDirs(path.Dir(dir)); err != nil {
+		return err
+	}
+
+	if err := w.tw.WriteHeader(tarHeader(tar.TypeDir, dir+"/", 0)); err != nil {
+		return err
+	}
+
+	w.dirs.Insert(dir)
+
+	return nil
+}
+
+// writeTarEntry writes a regular file to a tar archive.
+func writeTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(tarHeader(tar.TypeReg, name, size)); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// writeTarFS writes the contents of a filesystem to a tar archive, in lexical
+// order.
+func writeTarFS(tw *tar.Writer, fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+
+		if d.IsDir() {
+			return tw.WriteHeader(tarHeader(tar.TypeDir, name+"/", 0))
+		}
+
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("unexpected file type for %s", name)
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return writeTarEntry(tw, name, fi.Size(), f)
+	})
+}
+
+// tarHeader returns a header for a tar entry. Everything other than the name
+// and size is fixed, so that archives are reproducible regardless of when, where
+// and by whom they were created.
+func tarHeader(typeflag byte, name string, size int64) *tar.Header {
+	mode := int64(0o644)
+	if typeflag == tar.TypeDir {
+		mode = 0o755
+	}
+
+	return &tar.Header{
+		Typeflag: typeflag,
+		Name:     name,
+		Size:     size,
+		Mode:     mode,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}
+}
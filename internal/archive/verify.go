@@ -0,0 +1,201 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"fmt"
+	"io/fs"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// BlobProblem is a problem with a blob in an archive.
+type BlobProblem struct {
+	// Digest is the digest of the blob.
+	Digest v1.Hash `json:"digest"`
+	// RefName is the reference name of the (first) image that references the
+	// blob, if any.
+	RefName string `json:"refName,omitempty"`
+	// Reason describes the problem.
+	Reason string `json:"reason"`
+}
+
+// VerifyResult is the result of verifying an archive.
+type VerifyResult struct {
+	// Blobs is the number of blobs that were checked.
+	Blobs int `json:"blobs"`
+	// Corrupt are blobs whose content doesn't match their digest (or size).
+	Corrupt []BlobProblem `json:"corrupt,omitempty"`
+	// Missing are blobs that are referenced by an image but aren't present.
+	Missing []BlobProblem `json:"missing,omitempty"`
+	// Orphaned are blobs that aren't referenced by any image.
+	Orphaned []v1.Hash `json:"orphaned,omitempty"`
+	// MissingImages are expected images that aren't in the archive.
+	MissingImages []string `json:"missingImages,omitempty"`
+}
+
+// OK returns whether the archive is intact and complete. Orphaned blobs waste
+// space, but don't make an archive unusable.
+func (r *VerifyResult) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Missing) == 0 && len(r.MissingImages) == 0
+}
+
+// Verify checks the integrity and completeness of the archive. Every blob is
+// re-hashed and checked against its digest, every image in the index is
+// checked to have all its blobs present, and any blobs not referenced by an
+// image are reported as orphaned. If images is non-empty, each of the images
+// is also checked to be present in the archive.
+func (a *Archive) Verify(images sets.String) (*VerifyResult, error) {
+	result := &VerifyResult{}
+
+	blobs, err := a.Blobs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	corrupt := sets.NewString()
+	for _, digest := range blobs {
+		ok, err := a.verifyBlob(digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify blob %s: %w", digest, err)
+		}
+
+		if !ok {
+			result.Corrupt = append(result.Corrupt, BlobProblem{Digest: digest, Reason: "content does not match digest"})
+			corrupt.Insert(digest.String())
+		}
+	}
+	result.Blobs = len(blobs)
+
+	// Corrupt manifests are treated as missing, so that their children are
+	// not parsed.
+	readBlob := func(desc v1.Descriptor) ([]byte, error) {
+		if corrupt.Has(desc.Digest.String()) {
+			return nil, fs.ErrNotExist
+		}
+
+		return a.ReadBlob(desc.Digest)
+	}
+
+	referenced := sets.NewString()
+	for _, desc := range a.index.Manifests {
+		refName := desc.Annotations[AnnotationRefName]
+
+		err := walkDescriptors([]v1.Descriptor{desc}, readBlob, func(desc v1.Descriptor) error {
+			if referenced.Has(desc.Digest.String()) {
+				return nil
+			}
+			referenced.Insert(desc.Digest.String())
+
+			size, err := a.BlobSize(desc.Digest)
+			if err != nil {
+				result.Missing = append(result.Missing, BlobProblem{Digest: desc.Digest, RefName: refName, Reason: "blob not found"})
+				return nil
+			}
+
+			if size != desc.Size && !corrupt.Has(desc.Digest.String()) {
+				result.Corrupt = append(result.Corrupt, BlobProblem{
+					Digest:  desc.Digest,
+					RefName: refName,
+					Reason:  fmt.Sprintf("expected size %d, got %d", desc.Size, size),
+				})
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify %s: %w", desc.Digest, err)
+		}
+	}
+
+	for _, digest := range blobs {
+		if !referenced.Has(digest.String()) {
+			result.Orphaned = append(result.Orphaned, digest)
+		}
+	}
+
+	result.MissingImages, err = a.missingImages(images)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// verifyBlob returns whether the content of a blob matches its digest.
+func (a *Archive) verifyBlob(digest v1.Hash) (bool, error) {
+	if digest.Algorithm != "sha256" {
+		return false, fmt.Errorf("unsupported digest algorithm %q", digest.Algorithm)
+	}
+
+	f, err := a.Blob(digest)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	got, _, err := v1.SHA256(f)
+	if err != nil {
+		return false, err
+	}
+
+	return got == digest, nil
+}
+
+// missingImages returns the images that are not in the archive. Images are
+// matched by reference name, or by digest for digest references.
+func (a *Archive) missingImages(images sets.String) ([]string, error) {
+	refNames := sets.NewString()
+	digests := sets.NewString()
+	for _, desc := range a.index.Manifests {
+		digests.Insert(desc.Digest.String())
+
+		if refName, ok := desc.Annotations[AnnotationRefName]; ok {
+			// Normalize the reference name, in case the archive was created
+			// by another tool.
+			if ref, err := name.ParseReference(refName); err == nil {
+				refName = ref.Name()
+			}
+
+			refNames.Insert(refName)
+		}
+	}
+
+	var missing []string
+	for _, image := range images.List() {
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse image reference %q: %w", image, err)
+		}
+
+		if refNames.Has(ref.Name()) {
+			continue
+		}
+
+		if d, ok := ref.(name.Digest); ok && digests.Has(d.DigestStr()) {
+			continue
+		}
+
+		missing = append(missing, image)
+	}
+
+	return missing, nil
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package archive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Walk calls fn for every blob in the archive reachable from a set of
+// descriptors (eg. those in the index). Each blob is visited once, parents
+// before children, and missing manifests are treated as leaves.
+func (a *Archive) Walk(descs []v1.Descriptor, fn func(v1.Descriptor) error) error {
+	return walkDescriptors(descs, func(desc v1.Descriptor) ([]byte, error) {
+		return a.ReadBlob(desc.Digest)
+	}, fn)
+}
+
+// walkDescriptors calls fn for every blob reachable from a set of descriptors
+// (the descriptors themselves, and for indexes and manifests, their children).
+// Each blob is visited once, parents before children. Manifests are read with
+// readBlob; if it returns an fs.ErrNotExist error the manifest is treated as a
+// leaf, so fn can report missing blobs without aborting the walk.
+func walkDescriptors(descs []v1.Descriptor, readBlob func(v1.Descriptor) ([]byte, error), fn func(v1.Descriptor) error) error {
+	visited := sets.NewString()
+
+	var walk func(desc v1.Descriptor) error
+	walk = func(desc v1.Descriptor) error {
+		if visited.Has(desc.Digest.String()) {
+			return nil
+		}
+		visited.Insert(desc.Digest.String())
+
+		if err := fn(desc); err != nil {
+			return err
+		}
+
+		if !desc.MediaType.IsIndex() && !desc.MediaType.IsImage() {
+			return nil
+		}
+
+		raw, err := readBlob(desc)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read manifest %s: %w", desc.Digest, err)
+		}
+
+		var children []v1.Descriptor
+		if desc.MediaType.IsIndex() {
+			var index v1.IndexManifest
+			if err := json.Unmarshal(raw, &index); err != nil {
+				return fmt.Errorf("failed to parse index %s: %w", desc.Digest, err)
+			}
+
+			children = index.Manifests
+		} else {
+			var manifest v1.Manifest
+			if err := json.Unmarshal(raw, &manifest); err != nil {
+				return fmt.Errorf("failed to parse manifest %s: %w", desc.Digest, err)
+			}
+
+			children = append([]v1.Descriptor{manifest.Config}, manifest.Layers...)
+		}
+
+		for _, child := range children {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, desc := range descs {
+		if err := walk(desc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
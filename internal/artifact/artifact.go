@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package artifact builds OCI artifacts (non-image content such as Helm charts
+// and files) to add to image archives.
+package artifact
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Blob is the content of an artifact (its config or a layer).
+type Blob struct {
+	v1.Descriptor
+	// Open returns the content of the blob.
+	Open func() (io.ReadCloser, error)
+}
+
+// Artifact is an OCI artifact.
+type Artifact struct {
+	// RefName is the reference name of the artifact (eg. "charts/nginx:1.0.0").
+	RefName string
+	// Manifest is the raw artifact manifest.
+	Manifest []byte
+	// Blobs are the config and layers of the artifact.
+	Blobs []Blob
+
+	desc v1.Descriptor
+}
+
+// Descriptor returns the descriptor of the artifact's manifest.
+func (a *Artifact) Descriptor() v1.Descriptor {
+	return a.desc
+}
+
+// manifest is an OCI image manifest, including the artifactType field (which
+// isn't supported by go-containerregistry's v1.Manifest).
+type manifest struct {
+	SchemaVersion int64             `json:"schemaVersion"`
+	MediaType     types.MediaType   `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        v1.Descriptor     `json:"config"`
+	Layers        []v1.Descriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+func (m *manifest) artifactType() string {
+	if m.ArtifactType != "" {
+		return m.ArtifactType
+	}
+
+	return string(m.Config.MediaType)
+}
+
+// New creates an artifact from a config and set of layers. If artifactType is
+// empty, the artifact type is implied by the config media type.
+func New(refName, artifactType string, config Blob, layers []Blob, annotations map[string]string) (*Artifact, error) {
+	m := manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		ArtifactType:  artifactType,
+		Config:        config.Descriptor,
+		Layers:        []v1.Descriptor{},
+		Annotations:   annotations,
+	}
+
+	blobs := []Blob{config}
+	for _, layer := range layers {
+		m.Layers = append(m.Layers, layer.Descriptor)
+		blobs = append(blobs, layer)
+	}
+
+	rawManifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, size, err := v1.SHA256(bytes.NewReader(rawManifest))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Artifact{
+		RefName:  refName,
+		Manifest: rawManifest,
+		Blobs:    blobs,
+		desc: v1.Descriptor{
+			MediaType:    m.MediaType,
+			Size:         size,
+			Digest:       digest,
+			ArtifactType: m.artifactType(),
+		},
+	}, nil
+}
+
+// BytesBlob returns a blob with the given content.
+func BytesBlob(mediaType types.MediaType, data []byte, annotations map[string]string) Blob {
+	digest, size, _ := v1.SHA256(bytes.NewReader(data))
+
+	return Blob{
+		Descriptor: v1.Descriptor{
+			MediaType:   mediaType,
+			Size:        size,
+			Digest:      digest,
+			Annotations: annotations,
+		},
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+}
+
+// FileBlob returns a blob with the content of a file. The file is hashed
+// up front, and read again when the blob is opened.
+func FileBlob(mediaType types.MediaType, path string, annotations map[string]string) (Blob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Blob{}, err
+	}
+	defer f.Close()
+
+	digest, size, err := v1.SHA256(f)
+	if err != nil {
+		return Blob{}, err
+	}
+
+	return Blob{
+		Descriptor: v1.Descriptor{
+			MediaType:   mediaType,
+			Size:        size,
+			Digest:      digest,
+			Annotations: annotations,
+		},
+		Open: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+	}, nil
+}
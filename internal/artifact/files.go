@@ -0,0 +1,259 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package artifact
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// DefaultArtifactType is the artifact type used when none is specified
+	// (the same as `oras push`).
+	DefaultArtifactType = "application/vnd.unknown.artifact.v1"
+	// EmptyConfigMediaType is the media type of the empty ("{}") config used
+	// by artifacts without a config of their own.
+	EmptyConfigMediaType types.MediaType = "application/vnd.oci.empty.v1+json"
+	// DefaultFileMediaType is the media type used for files when none is
+	// specified (the same as `oras push`).
+	DefaultFileMediaType types.MediaType = "application/vnd.oci.image.layer.v1.tar"
+	// DirectoryMediaType is the media type of directories, which are stored
+	// as gzipped tar archives.
+	DirectoryMediaType types.MediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+const (
+	// AnnotationTitle is the file name of a layer.
+	AnnotationTitle = "org.opencontainers.image.title"
+	// AnnotationUnpack marks a layer as a directory that should be unpacked
+	// when pulled by ORAS.
+	AnnotationUnpack = "io.deis.oras.content.unpack"
+	// AnnotationContentDigest is the digest of the uncompressed tar archive
+	// of a directory layer.
+	AnnotationContentDigest = "io.deis.oras.content.digest"
+)
+
+// File is a file or directory to include in an artifact.
+type File struct {
+	// Path is the path to the file or directory.
+	Path string
+	// MediaType is the media type of the file. Defaults to DefaultFileMediaType
+	// for files, and is always DirectoryMediaType for directories.
+	MediaType types.MediaType
+}
+
+// FromFiles creates an artifact from a set of files and directories, in the
+// same form as `oras push` (so it can be pulled with `oras pull`). Each file
+// is a layer, titled with its base name. Directories are stored as gzipped
+// tar archives, which ORAS unpacks when they are pulled.
+func FromFiles(refName, artifactType string, files []File, annotations map[string]string) (*Artifact, error) {
+	if _, err := name.NewTag(refName); err != nil {
+		return nil, fmt.Errorf("invalid reference name %q: %w", refName, err)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("artifact must include at least one file")
+	}
+
+	if artifactType == "" {
+		artifactType = DefaultArtifactType
+	}
+
+	titles := make(map[string]bool)
+	var layers []Blob
+	for _, f := range files {
+		fi, err := os.Stat(f.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		title := filepath.Base(f.Path)
+		if titles[title] {
+			return nil, fmt.Errorf("duplicate file name %q", title)
+		}
+		titles[title] = true
+
+		var layer Blob
+		if fi.IsDir() {
+			if f.MediaType != "" && f.MediaType != DirectoryMediaType {
+				return nil, fmt.Errorf("directory %q must have media type %s", f.Path, DirectoryMediaType)
+			}
+
+			layer, err = dirBlob(f.Path)
+		} else {
+			mediaType := f.MediaType
+			if mediaType == "" {
+				mediaType = DefaultFileMediaType
+			}
+
+			layer, err = FileBlob(mediaType, f.Path, nil)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %w", f.Path, err)
+		}
+
+		if layer.Annotations == nil {
+			layer.Annotations = make(map[string]string)
+		}
+		layer.Annotations[AnnotationTitle] = title
+
+		layers = append(layers, layer)
+	}
+
+	config := BytesBlob(EmptyConfigMediaType, []byte("{}"), nil)
+
+	return New(refName, artifactType, config, layers, annotations)
+}
+
+// dirBlob returns a blob containing a gzipped tar archive of a directory. The
+// archive is reproducible, so rather than keeping it around it's created once
+// to compute its digest, and again each time the blob is opened.
+func dirBlob(dir string) (Blob, error) {
+	digester := sha256.New()
+	contentDigester := sha256.New()
+	counter := &countingWriter{w: digester}
+
+	if err := packDir(counter, contentDigester, dir); err != nil {
+		return Blob{}, err
+	}
+
+	return Blob{
+		Descriptor: v1.Descriptor{
+			MediaType: DirectoryMediaType,
+			Size:      counter.n,
+			Digest:    sha256Hash(digester),
+			Annotations: map[string]string{
+				AnnotationUnpack:        "true",
+				AnnotationContentDigest: sha256Hash(contentDigester).String(),
+			},
+		},
+		Open: func() (io.ReadCloser, error) {
+			pr, pw := io.Pipe()
+			go func() {
+				pw.CloseWithError(packDir(pw, io.Discard, dir))
+			}()
+
+			return pr, nil
+		},
+	}, nil
+}
+
+// packDir writes a gzipped tar archive of a directory to dst (and the
+// uncompressed archive to rawDst). Entries are prefixed with the name of the
+// directory, are in lexical order, and have fixed timestamps and ownership.
+func packDir(dst, rawDst io.Writer, dir string) error {
+	gw := gzip.NewWriter(dst)
+	tw := tar.NewWriter(io.MultiWriter(gw, rawDst))
+
+	prefix := filepath.Base(dir)
+	fsys := os.DirFS(dir)
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:    path.Join(prefix, name),
+			Mode:    0o644,
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+
+		switch {
+		case d.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0o755
+		case d.Type().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = fi.Size()
+			// Preserve the executable bit (eg. for binaries).
+			if fi.Mode()&0o111 != 0 {
+				hdr.Mode = 0o755
+			}
+		default:
+			return fmt.Errorf("unsupported file type for %s", name)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+func sha256Hash(h hash.Hash) v1.Hash {
+	return v1.Hash{
+		Algorithm: "sha256",
+		Hex:       hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
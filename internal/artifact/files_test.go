@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package artifact_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/artifact"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	binPath := filepath.Join(dir, "kubectl")
+	require.NoError(t, os.WriteFile(binPath, []byte("#!/bin/sh\n"), 0o755))
+
+	pluginsDir := filepath.Join(dir, "plugins")
+	require.NoError(t, os.MkdirAll(filepath.Join(pluginsDir, "bin"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(pluginsDir, "README"), []byte("plugins"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(pluginsDir, "bin", "kubectl-foo"), []byte("foo"), 0o755))
+
+	files := []artifact.File{
+		{Path: binPath, MediaType: "application/vnd.example.binary"},
+		{Path: pluginsDir},
+	}
+
+	a, err := artifact.FromFiles("tools/kubectl:v1.30.0", "", files, map[string]string{"example": "true"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "tools/kubectl:v1.30.0", a.RefName)
+	assert.Equal(t, artifact.DefaultArtifactType, a.Descriptor().ArtifactType)
+
+	var manifest v1.Manifest
+	require.NoError(t, json.Unmarshal(a.Manifest, &manifest))
+
+	assert.Equal(t, artifact.EmptyConfigMediaType, manifest.Config.MediaType)
+	assert.Equal(t, "true", manifest.Annotations["example"])
+	assert.Equal(t, []byte("{}"), readBlob(t, a.Blobs[0]))
+
+	require.Len(t, manifest.Layers, 2)
+
+	assert.Equal(t, "application/vnd.example.binary", string(manifest.Layers[0].MediaType))
+	assert.Equal(t, "kubectl", manifest.Layers[0].Annotations[artifact.AnnotationTitle])
+	assert.Equal(t, []byte("#!/bin/sh\n"), readBlob(t, a.Blobs[1]))
+
+	assert.Equal(t, artifact.DirectoryMediaType, manifest.Layers[1].MediaType)
+	assert.Equal(t, "plugins", manifest.Layers[1].Annotations[artifact.AnnotationTitle])
+	assert.Equal(t, "true", manifest.Layers[1].Annotations[artifact.AnnotationUnpack])
+
+	t.Run("Directory", func(t *testing.T) {
+		layer := readBlob(t, a.Blobs[2])
+
+		digest, size, err := v1.SHA256(bytes.NewReader(layer))
+		require.NoError(t, err)
+		assert.Equal(t, manifest.Layers[1].Digest, digest)
+		assert.Equal(t, manifest.Layers[1].Size, size)
+
+		gr, err := gzip.NewReader(bytes.NewReader(layer))
+		require.NoError(t, err)
+
+		rawLayer, err := io.ReadAll(gr)
+		require.NoError(t, err)
+
+		contentDigest, _, err := v1.SHA256(bytes.NewReader(rawLayer))
+		require.NoError(t, err)
+		assert.Equal(t, contentDigest.String(), manifest.Layers[1].Annotations[artifact.AnnotationContentDigest])
+
+		modes := make(map[string]int64)
+		tr := tar.NewReader(bytes.NewReader(rawLayer))
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			modes[hdr.Name] = hdr.Mode
+		}
+
+		assert.Equal(t, map[string]int64{
+			"plugins/":                0o755,
+			"plugins/README":          0o644,
+			"plugins/bin/":            0o755,
+			"plugins/bin/kubectl-foo": 0o755,
+		}, modes)
+	})
+
+	t.Run("Reproducible", func(t *testing.T) {
+		again, err := artifact.FromFiles("tools/kubectl:v1.30.0", "", files, map[string]string{"example": "true"})
+		require.NoError(t, err)
+
+		assert.Equal(t, a.Descriptor().Digest, again.Descriptor().Digest)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := artifact.FromFiles("tools/kubectl:v1.30.0", "", nil, nil)
+		assert.Error(t, err)
+
+		_, err = artifact.FromFiles("Invalid Name", "", files, nil)
+		assert.Error(t, err)
+
+		_, err = artifact.FromFiles("tools/kubectl:v1.30.0", "", []artifact.File{{Path: binPath}, {Path: binPath}}, nil)
+		assert.Error(t, err)
+
+		_, err = artifact.FromFiles("tools/kubectl:v1.30.0", "", []artifact.File{{Path: pluginsDir, MediaType: "text/plain"}}, nil)
+		assert.Error(t, err)
+	})
+}
+
+func readBlob(t *testing.T, blob artifact.Blob) []byte {
+	rc, err := blob.Open()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, rc.Close())
+	})
+
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+
+	return data
+}
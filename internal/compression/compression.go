@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package compression compresses image archives.
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Algorithm is a compression algorithm.
+type Algorithm string
+
+const (
+	None Algorithm = "none"
+	Gzip Algorithm = "gzip"
+	Zstd Algorithm = "zstd"
+	Xz   Algorithm = "xz"
+	Lz4  Algorithm = "lz4"
+)
+
+// DefaultLevel selects the default compression level of an algorithm.
+const DefaultLevel = 0
+
+// Options configures compression.
+type Options struct {
+	// Algorithm is the compression algorithm.
+	Algorithm Algorithm
+	// Level is the algorithm specific compression level (eg. 1-9 for gzip,
+	// 1-22 for zstd). DefaultLevel selects the algorithm's default.
+	Level int
+	// Threads is the number of threads to use for compression (for the
+	// algorithms that support it). Zero uses all available CPUs.
+	Threads int
+}
+
+// String returns a description of the compression (eg. "zstd:19").
+func (o Options) String() string {
+	if o.Level == DefaultLevel {
+		return string(o.Algorithm)
+	}
+
+	return fmt.Sprintf("%s:%d", o.Algorithm, o.Level)
+}
+
+// ParseAlgorithm parses the name of a compression algorithm.
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch alg := Algorithm(strings.ToLower(s)); alg {
+	case None, Gzip, Zstd, Xz, Lz4:
+		return alg, nil
+	case "":
+		return None, nil
+	default:
+		return "", fmt.Errorf("unsupported compression algorithm %q", s)
+	}
+}
+
+// FromFilename infers the compression algorithm from a file extension (eg.
+// zstd for "images.tar.zst").
+func FromFilename(filename string) Algorithm {
+	switch filepath.Ext(filename) {
+	case ".gz", ".gzip", ".tgz":
+		return Gzip
+	case ".zst", ".zstd":
+		return Zstd
+	case ".xz":
+		return Xz
+	case ".lz4":
+		return Lz4
+	default:
+		return None
+	}
+}
+
+// Validate checks that the compression level is supported by the algorithm.
+func (o Options) Validate() error {
+	if o.Threads < 0 {
+		return errors.New("number of threads must not be negative")
+	}
+
+	if o.Level == DefaultLevel {
+		return nil
+	}
+
+	var min, max int
+	switch o.Algorithm {
+	case Gzip, Xz, Lz4:
+		min, max = 1, 9
+	case Zstd:
+		min, max = 1, 22
+	default:
+		return fmt.Errorf("compression level is not supported for %q", o.Algorithm)
+	}
+
+	if o.Level < min || o.Level > max {
+		return fmt.Errorf("compression level for %s must be between %d and %d", o.Algorithm, min, max)
+	}
+
+	return nil
+}
+
+// NewWriter returns a writer that compresses its output. Closing the writer
+// flushes any buffered data, but does not close w.
+func NewWriter(w io.Writer, opts Options) (io.WriteCloser, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	threads := opts.Threads
+	if threads == 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+
+	switch opts.Algorithm {
+	case None, "":
+		return nopCloser{w}, nil
+	case Gzip:
+		level := pgzip.DefaultCompression
+		if opts.Level != DefaultLevel {
+			level = opts.Level
+		}
+
+		gw, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+
+		// Compress in 1 MiB blocks, with up to two blocks in flight per thread.
+		if err := gw.SetConcurrency(1<<20, 2*threads); err != nil {
+			return nil, err
+		}
+
+		return gw, nil
+	case Zstd:
+		level := zstd.SpeedDefault
+		if opts.Level != DefaultLevel {
+			level = zstd.EncoderLevelFromZstd(opts.Level)
+		}
+
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(threads))
+	case Xz:
+		cfg := xz.WriterConfig{}
+		if opts.Level != DefaultLevel {
+			cfg.DictCap = xzDictCap[opts.Level]
+		}
+
+		return cfg.NewWriter(w)
+	case Lz4:
+		lw := lz4.NewWriter(w)
+
+		lz4Opts := []lz4.Option{lz4.ConcurrencyOption(threads)}
+		if opts.Level != DefaultLevel {
+			lz4Opts = append(lz4Opts, lz4.CompressionLevelOption(lz4Levels[opts.Level]))
+		}
+
+		if err := lw.Apply(lz4Opts...); err != nil {
+			return nil, err
+		}
+
+		return lw, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", opts.Algorithm)
+	}
+}
+
+// xzDictCap maps xz preset levels to dictionary sizes (the only setting the xz
+// package supports), following the xz(1) presets.
+var xzDictCap = map[int]int{
+	1: 1 << 20,
+	2: 2 << 20,
+	3: 4 << 20,
+	4: 4 << 20,
+	5: 8 << 20,
+	6: 8 << 20,
+	7: 16 << 20,
+	8: 32 << 20,
+	9: 64 << 20,
+}
+
+var lz4Levels = map[int]lz4.CompressionLevel{
+	1: lz4.Level1,
+	2: lz4.Level2,
+	3: lz4.Level3,
+	4: lz4.Level4,
+	5: lz4.Level5,
+	6: lz4.Level6,
+	7: lz4.Level7,
+	8: lz4.Level8,
+	9: lz4.Level9,
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
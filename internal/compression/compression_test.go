@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package compression_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/compression"
+	"github.com/dpeckett/uncompr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWriter(t *testing.T) {
+	// Somewhat compressible data, large enough to be split across threads.
+	data := make([]byte, 4<<20)
+	r := rand.New(rand.NewSource(0))
+	for i := range data {
+		data[i] = byte('a' + r.Intn(4))
+	}
+
+	tests := []struct {
+		name string
+		opts compression.Options
+	}{
+		{name: "None", opts: compression.Options{Algorithm: compression.None}},
+		{name: "Gzip", opts: compression.Options{Algorithm: compression.Gzip}},
+		{name: "Gzip Level", opts: compression.Options{Algorithm: compression.Gzip, Level: 1}},
+		{name: "Zstd", opts: compression.Options{Algorithm: compression.Zstd}},
+		{name: "Zstd Level", opts: compression.Options{Algorithm: compression.Zstd, Level: 3}},
+		{name: "Xz", opts: compression.Options{Algorithm: compression.Xz, Level: 1}},
+		{name: "Lz4", opts: compression.Options{Algorithm: compression.Lz4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compress := func(threads int) []byte {
+				opts := tt.opts
+				opts.Threads = threads
+
+				var buf bytes.Buffer
+				w, err := compression.NewWriter(&buf, opts)
+				require.NoError(t, err)
+
+				_, err = w.Write(data)
+				require.NoError(t, err)
+				require.NoError(t, w.Close())
+
+				return buf.Bytes()
+			}
+
+			compressed := compress(1)
+
+			r, err := uncompr.NewReader(bytes.NewReader(compressed))
+			require.NoError(t, err)
+
+			decompressed, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+
+			assert.Equal(t, data, decompressed)
+
+			// The output shouldn't depend on the number of threads.
+			assert.Equal(t, compressed, compress(4))
+		})
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	assert.NoError(t, compression.Options{Algorithm: compression.Zstd, Level: 22}.Validate())
+	assert.Error(t, compression.Options{Algorithm: compression.Gzip, Level: 10}.Validate())
+	assert.Error(t, compression.Options{Algorithm: compression.None, Level: 1}.Validate())
+}
@@ -112,6 +112,38 @@ func (e *ImageReferenceExtractor) ExtractImageReferences(objects []unstructured.
 	return images, nil
 }
 
+// ImageSource identifies an object that an image reference was extracted from.
+type ImageSource struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+// ExtractImageSources extracts image references from objects, along with the
+// objects each image was referenced by (in the order they were given).
+func (e *ImageReferenceExtractor) ExtractImageSources(objects []unstructured.Unstructured) (map[string][]ImageSource, error) {
+	sources := make(map[string][]ImageSource)
+
+	for _, object := range objects {
+		imagesForObject, err := e.extractImagesFromObject(object)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, image := range imagesForObject.List() {
+			sources[image] = append(sources[image], ImageSource{
+				APIVersion: object.GetAPIVersion(),
+				Kind:       object.GetKind(),
+				Namespace:  object.GetNamespace(),
+				Name:       object.GetName(),
+			})
+		}
+	}
+
+	return sources, nil
+}
+
 func (e *ImageReferenceExtractor) extractImagesFromObject(object unstructured.Unstructured) (sets.String, error) {
 	images := sets.NewString()
 
@@ -19,6 +19,7 @@
 package extractor_test
 
 import (
+	"os"
 	"testing"
 
 	"github.com/dpeckett/airgapify/internal/extractor"
@@ -57,3 +58,68 @@ func TestImageReferenceExtractor(t *testing.T) {
 	expected := sets.NewString("image1:v1", "image2:v2")
 	assert.True(t, expected.Equal(result))
 }
+
+func TestExtractImageSources(t *testing.T) {
+	objects := []unstructured.Unstructured{
+		{
+			Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata": map[string]interface{}{
+					"name":      "pod1",
+					"namespace": "default",
+				},
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":  "container1",
+							"image": "image1:v1",
+						},
+					},
+				},
+			},
+		},
+		{
+			Object: map[string]interface{}{
+				"apiVersion": "airgapify.pecke.tt/v1alpha1",
+				"kind":       "Config",
+				"metadata": map[string]interface{}{
+					"name": "config",
+				},
+				"spec": map[string]interface{}{
+					"images": []interface{}{"image1:v1", "image2:v2"},
+				},
+			},
+		},
+	}
+
+	e := extractor.NewImageReferenceExtractor(extractor.DefaultRules)
+	result, err := e.ExtractImageSources(objects)
+	require.NoError(t, err)
+
+	config := extractor.ImageSource{APIVersion: "airgapify.pecke.tt/v1alpha1", Kind: "Config", Name: "config"}
+
+	assert.Equal(t, map[string][]extractor.ImageSource{
+		"image1:v1": {
+			{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: "pod1"},
+			config,
+		},
+		"image2:v2": {config},
+	}, result)
+}
+
+func TestRewriteImageReferences(t *testing.T) {
+	data, err := os.ReadFile("testdata/manifests.yaml")
+	require.NoError(t, err)
+
+	expected, err := os.ReadFile("testdata/manifests.rewritten.yaml")
+	require.NoError(t, err)
+
+	e := extractor.NewImageReferenceExtractor(extractor.DefaultRules)
+	rewritten, err := e.RewriteImageReferences(data, func(image string) (string, error) {
+		return "registry.internal/" + image, nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, string(expected), string(rewritten))
+}
@@ -0,0 +1,312 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package extractor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dpeckett/airgapify/internal/util/jsonpath"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// RewriteFunc returns the replacement for an image reference.
+type RewriteFunc func(image string) (string, error)
+
+// RewriteImageReferences rewrites the image references in a stream of YAML
+// (or JSON) documents, located using the extraction rules. Only the image
+// references themselves are modified, so formatting and comments are preserved.
+func (e *ImageReferenceExtractor) RewriteImageReferences(data []byte, rewrite RewriteFunc) ([]byte, error) {
+	var edits []scalarEdit
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		docEdits, err := e.rewriteDocument(&doc, rewrite)
+		if err != nil {
+			return nil, err
+		}
+
+		edits = append(edits, docEdits...)
+	}
+
+	return applyScalarEdits(data, edits)
+}
+
+func (e *ImageReferenceExtractor) rewriteDocument(doc *yaml.Node, rewrite RewriteFunc) ([]scalarEdit, error) {
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	// Build a generic representation of the document for evaluating JSONPath
+	// expressions against, in which strings are pointers to the values of the
+	// underlying nodes (so we can find the node that each result came from).
+	scalars := make(map[*string]*yaml.Node)
+	obj, err := nodeValue(doc.Content[0], scalars)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := obj.(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+
+	apiVersion, _ := m["apiVersion"].(*string)
+	kind, _ := m["kind"].(*string)
+	if apiVersion == nil || kind == nil {
+		return nil, nil
+	}
+
+	gvk := schema.FromAPIVersionAndKind(*apiVersion, *kind)
+
+	var edits []scalarEdit
+	for _, rule := range e.rules {
+		if gvk != rule.GroupVersionKind() {
+			continue
+		}
+
+		for _, jsonPath := range rule.Paths {
+			j := jsonpath.New("rewriter").AllowMissingKeys(true)
+			if err := j.Parse("{ " + jsonPath + " }"); err != nil {
+				return nil, err
+			}
+
+			results, err := j.FindResults(obj)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find image references in object %s: %w", *kind, err)
+			}
+
+			for _, r := range results {
+				for _, v := range r {
+					if v.Kind() == reflect.Interface {
+						v = v.Elem()
+					}
+
+					ptr, ok := v.Interface().(*string)
+					if !ok {
+						continue
+					}
+
+					node := scalars[ptr]
+
+					image, err := rewrite(node.Value)
+					if err != nil {
+						return nil, err
+					}
+
+					if image != node.Value {
+						edits = append(edits, scalarEdit{node: node, value: image})
+					}
+				}
+			}
+		}
+	}
+
+	return edits, nil
+}
+
+// nodeValue converts a YAML node into a generic value. String scalars are
+// represented as pointers to the node's value.
+func nodeValue(node *yaml.Node, scalars map[*string]*yaml.Node) (any, error) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		m := make(map[string]any, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v, err := nodeValue(node.Content[i+1], scalars)
+			if err != nil {
+				return nil, err
+			}
+
+			m[node.Content[i].Value] = v
+		}
+
+		return m, nil
+	case yaml.SequenceNode:
+		s := make([]any, 0, len(node.Content))
+		for _, child := range node.Content {
+			v, err := nodeValue(child, scalars)
+			if err != nil {
+				return nil, err
+			}
+
+			s = append(s, v)
+		}
+
+		return s, nil
+	case yaml.AliasNode:
+		return nodeValue(node.Alias, scalars)
+	case yaml.ScalarNode:
+		if node.ShortTag() == "!!str" {
+			scalars[&node.Value] = node
+			return &node.Value, nil
+		}
+
+		var v any
+		if err := node.Decode(&v); err != nil {
+			return nil, err
+		}
+
+		return v, nil
+	default:
+		return nil, nil
+	}
+}
+
+// scalarEdit replaces the value of a scalar node.
+type scalarEdit struct {
+	node  *yaml.Node
+	value string
+}
+
+// applyScalarEdits replaces scalars in the original document text, so that
+// everything else is left untouched.
+func applyScalarEdits(data []byte, edits []scalarEdit) ([]byte, error) {
+	if len(edits) == 0 {
+		return data, nil
+	}
+
+	lineOffsets := []int{0}
+	for i, b := range data {
+		if b == '\n' {
+			lineOffsets = append(lineOffsets, i+1)
+		}
+	}
+
+	type replacement struct {
+		start, end int
+		text       string
+	}
+
+	seen := make(map[*yaml.Node]bool)
+	var replacements []replacement
+	for _, edit := range edits {
+		// The same node may be matched by more than one path.
+		if seen[edit.node] {
+			continue
+		}
+		seen[edit.node] = true
+
+		if edit.node.Line < 1 || edit.node.Line > len(lineOffsets) {
+			return nil, fmt.Errorf("invalid position for image reference %q", edit.node.Value)
+		}
+
+		// Columns are counted in characters, not bytes.
+		start := lineOffsets[edit.node.Line-1]
+		for col := 1; col < edit.node.Column && start < len(data); col++ {
+			_, size := utf8.DecodeRune(data[start:])
+			start += size
+		}
+
+		end, err := scalarEnd(data, start, edit.node)
+		if err != nil {
+			return nil, err
+		}
+
+		replacements = append(replacements, replacement{
+			start: start,
+			end:   end,
+			text:  quoteScalar(edit.value, edit.node.Style),
+		})
+	}
+
+	sort.Slice(replacements, func(i, j int) bool {
+		return replacements[i].start < replacements[j].start
+	})
+
+	var buf bytes.Buffer
+	var pos int
+	for _, r := range replacements {
+		buf.Write(data[pos:r.start])
+		buf.WriteString(r.text)
+		pos = r.end
+	}
+	buf.Write(data[pos:])
+
+	return buf.Bytes(), nil
+}
+
+// scalarEnd returns the offset of the end of the scalar token starting at
+// start.
+func scalarEnd(data []byte, start int, node *yaml.Node) (int, error) {
+	if node.Style&yaml.TaggedStyle != 0 {
+		return 0, fmt.Errorf("unsupported tagged image reference %q", node.Value)
+	}
+
+	switch node.Style {
+	case 0:
+		end := start + len(node.Value)
+		if end > len(data) || string(data[start:end]) != node.Value {
+			return 0, fmt.Errorf("unsupported multi-line image reference %q", node.Value)
+		}
+
+		return end, nil
+	case yaml.SingleQuotedStyle:
+		for i := start + 1; i < len(data); i++ {
+			if data[i] == '\'' {
+				if i+1 < len(data) && data[i+1] == '\'' {
+					i++
+					continue
+				}
+
+				return i + 1, nil
+			}
+		}
+	case yaml.DoubleQuotedStyle:
+		for i := start + 1; i < len(data); i++ {
+			switch data[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, nil
+			}
+		}
+	default:
+		return 0, fmt.Errorf("unsupported block scalar image reference %q", node.Value)
+	}
+
+	return 0, fmt.Errorf("unterminated image reference %q", node.Value)
+}
+
+// quoteScalar formats a value in the given scalar style.
+func quoteScalar(value string, style yaml.Style) string {
+	switch style {
+	case yaml.SingleQuotedStyle:
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+	case yaml.DoubleQuotedStyle:
+		return fmt.Sprintf("%q", value)
+	default:
+		return value
+	}
+}
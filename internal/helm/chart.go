@@ -0,0 +1,296 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package helm packages Helm charts as OCI artifacts.
+package helm
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/airgapify/internal/artifact"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// ConfigMediaType is the media type of a Helm chart config (the chart metadata).
+	ConfigMediaType types.MediaType = "application/vnd.cncf.helm.config.v1+json"
+	// ChartLayerMediaType is the media type of a packaged Helm chart.
+	ChartLayerMediaType types.MediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	// ProvenanceLayerMediaType is the media type of a Helm chart provenance file.
+	ProvenanceLayerMediaType types.MediaType = "application/vnd.cncf.helm.chart.provenance.v1.prov"
+)
+
+// DefaultRepository is the repository charts are stored in by default.
+const DefaultRepository = "charts"
+
+// metadata is the subset of the chart metadata (Chart.yaml) that we need.
+type metadata struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// Artifact packages a Helm chart (either a chart directory or a packaged .tgz
+// chart) as an OCI artifact, in the same form as `helm push`. The reference
+// name of the artifact is <repository>/<chart name>:<chart version>.
+func Artifact(chartPath, repository string) (*artifact.Artifact, error) {
+	fi, err := os.Stat(chartPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var chartArchive, chartYAML []byte
+	if fi.IsDir() {
+		chartYAML, err = os.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	} else {
+		chartArchive, err = os.ReadFile(chartPath)
+		if err == nil {
+			chartYAML, err = readChartYAML(chartArchive)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chart metadata: %w", err)
+	}
+
+	// The config is the chart metadata, as JSON.
+	rawConfig, err := yaml.YAMLToJSON(chartYAML)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse chart metadata: %w", err)
+	}
+
+	var md metadata
+	if err := json.Unmarshal(rawConfig, &md); err != nil {
+		return nil, fmt.Errorf("failed to parse chart metadata: %w", err)
+	}
+
+	if md.Name == "" || md.Version == "" {
+		return nil, errors.New("chart metadata must include a name and version")
+	}
+
+	if fi.IsDir() {
+		chartArchive, err = packageChart(chartPath, md.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to package chart: %w", err)
+		}
+	}
+
+	layers := []artifact.Blob{
+		artifact.BytesBlob(ChartLayerMediaType, chartArchive, nil),
+	}
+
+	// Include the provenance file of a packaged chart, if it has one.
+	if !fi.IsDir() {
+		provenance, err := os.ReadFile(chartPath + ".prov")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read chart provenance: %w", err)
+		} else if err == nil {
+			layers = append(layers, artifact.BytesBlob(ProvenanceLayerMediaType, provenance, nil))
+		}
+	}
+
+	annotations := map[string]string{
+		"org.opencontainers.image.title":   md.Name,
+		"org.opencontainers.image.version": md.Version,
+	}
+	if md.Description != "" {
+		annotations["org.opencontainers.image.description"] = md.Description
+	}
+
+	if repository == "" {
+		repository = DefaultRepository
+	}
+
+	// OCI tags can't contain "+", so Helm replaces it with "_".
+	refName := strings.TrimSuffix(repository, "/") + "/" + md.Name + ":" + strings.ReplaceAll(md.Version, "+", "_")
+
+	config := artifact.BytesBlob(ConfigMediaType, rawConfig, nil)
+
+	return artifact.New(refName, "", config, layers, annotations)
+}
+
+// readChartYAML reads the Chart.yaml of a packaged chart.
+func readChartYAML(chartArchive []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(chartArchive))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("chart archive does not contain a Chart.yaml")
+			}
+
+			return nil, err
+		}
+
+		// The chart is in a directory named after it (subcharts are further
+		// down in its charts directory).
+		parts := strings.Split(path.Clean(hdr.Name), "/")
+		if len(parts) == 2 && parts[1] == "Chart.yaml" {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// packageChart packages a chart directory into a gzipped tar archive, in the
+// same layout as `helm package`. Files matching the chart's .helmignore are
+// excluded. The archive is reproducible (sorted, with fixed timestamps).
+func packageChart(chartDir, chartName string) ([]byte, error) {
+	ignore, err := loadHelmIgnore(filepath.Join(chartDir, ".helmignore"))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+
+	err = fs.WalkDir(os.DirFS(chartDir), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+
+		if ignore.matches(name, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("unsupported file type for %s", name)
+		}
+
+		data, err := os.ReadFile(filepath.Join(chartDir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(chartName, name),
+			Size:     int64(len(data)),
+			Mode:     0o644,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return err
+		}
+
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// helmIgnore is a (simplified) set of .helmignore rules. Patterns are shell
+// globs matched against the base name of a file, or against its path relative
+// to the chart if the pattern contains a slash. Patterns with a trailing slash
+// only match directories. Negated patterns are not supported.
+type helmIgnore []string
+
+func loadHelmIgnore(ignorePath string) (helmIgnore, error) {
+	f, err := os.Open(ignorePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules helmIgnore
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "!") {
+			return nil, fmt.Errorf("negated .helmignore pattern %q is not supported", line)
+		}
+
+		if _, err := path.Match(strings.TrimSuffix(line, "/"), ""); err != nil {
+			return nil, fmt.Errorf("invalid .helmignore pattern %q: %w", line, err)
+		}
+
+		rules = append(rules, line)
+	}
+
+	return rules, scanner.Err()
+}
+
+func (rules helmIgnore) matches(name string, isDir bool) bool {
+	for _, rule := range rules {
+		if strings.HasSuffix(rule, "/") {
+			if !isDir {
+				continue
+			}
+			rule = strings.TrimSuffix(rule, "/")
+		}
+
+		target := path.Base(name)
+		if strings.Contains(rule, "/") {
+			target = name
+			rule = strings.TrimPrefix(rule, "/")
+		}
+
+		if ok, _ := path.Match(rule, target); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package helm_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/artifact"
+	"github.com/dpeckett/airgapify/internal/helm"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifact(t *testing.T) {
+	a, err := helm.Artifact("testdata/mychart", "")
+	require.NoError(t, err)
+
+	assert.Equal(t, "charts/mychart:1.2.3_build.1", a.RefName)
+	assert.Equal(t, string(helm.ConfigMediaType), a.Descriptor().ArtifactType)
+
+	var manifest v1.Manifest
+	require.NoError(t, json.Unmarshal(a.Manifest, &manifest))
+
+	assert.Equal(t, helm.ConfigMediaType, manifest.Config.MediaType)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, helm.ChartLayerMediaType, manifest.Layers[0].MediaType)
+	assert.Equal(t, "1.2.3+build.1", manifest.Annotations["org.opencontainers.image.version"])
+
+	config := readBlob(t, a.Blobs[0])
+
+	var md map[string]any
+	require.NoError(t, json.Unmarshal(config, &md))
+	assert.Equal(t, "mychart", md["name"])
+	assert.Equal(t, "1.25", md["appVersion"])
+
+	chartArchive := readBlob(t, a.Blobs[1])
+
+	gr, err := gzip.NewReader(bytes.NewReader(chartArchive))
+	require.NoError(t, err)
+
+	var names []string
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		names = append(names, hdr.Name)
+	}
+
+	assert.Equal(t, []string{
+		"mychart/.helmignore",
+		"mychart/Chart.yaml",
+		"mychart/templates/deployment.yaml",
+		"mychart/values.yaml",
+	}, names)
+
+	t.Run("Reproducible", func(t *testing.T) {
+		again, err := helm.Artifact("testdata/mychart", "")
+		require.NoError(t, err)
+
+		assert.Equal(t, a.Descriptor().Digest, again.Descriptor().Digest)
+	})
+
+	t.Run("Packaged", func(t *testing.T) {
+		chartPath := filepath.Join(t.TempDir(), "mychart-1.2.3+build.1.tgz")
+		require.NoError(t, os.WriteFile(chartPath, chartArchive, 0o644))
+		require.NoError(t, os.WriteFile(chartPath+".prov", []byte("signature"), 0o644))
+
+		packaged, err := helm.Artifact(chartPath, "team/charts")
+		require.NoError(t, err)
+
+		assert.Equal(t, "team/charts/mychart:1.2.3_build.1", packaged.RefName)
+
+		require.Len(t, packaged.Blobs, 3)
+		assert.Equal(t, a.Blobs[1].Digest, packaged.Blobs[1].Digest)
+		assert.Equal(t, helm.ProvenanceLayerMediaType, packaged.Blobs[2].MediaType)
+	})
+}
+
+func readBlob(t *testing.T, blob artifact.Blob) []byte {
+	rc, err := blob.Open()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, rc.Close())
+	})
+
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+
+	return data
+}
@@ -19,6 +19,7 @@
 package loader
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"path/filepath"
@@ -27,17 +28,43 @@ import (
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
+// File is a manifest file that has been loaded.
+type File struct {
+	// Path is the path of the file ("-" for stdin).
+	Path string
+	// Data is the raw contents of the file.
+	Data []byte
+	// Objects are the objects decoded from the file.
+	Objects []unstructured.Unstructured
+}
+
 func LoadObjectsFromFiles(filePaths []string) ([]unstructured.Unstructured, error) {
+	files, err := LoadFiles(filePaths)
+	if err != nil {
+		return nil, err
+	}
+
 	var objects []unstructured.Unstructured
+	for _, f := range files {
+		objects = append(objects, f.Objects...)
+	}
+
+	return objects, nil
+}
+
+// LoadFiles loads the manifest files at the given paths (directories are
+// walked recursively).
+func LoadFiles(filePaths []string) ([]File, error) {
+	var files []File
 
 	for _, filePath := range filePaths {
 		if filePath == "-" {
-			fileObjects, err := loadObjectsFromReader(os.Stdin)
+			f, err := loadFileFromReader(filePath, os.Stdin)
 			if err != nil {
 				return nil, err
 			}
 
-			objects = append(objects, fileObjects...)
+			files = append(files, *f)
 
 			continue
 		}
@@ -48,12 +75,12 @@ func LoadObjectsFromFiles(filePaths []string) ([]unstructured.Unstructured, erro
 		}
 
 		if !fi.IsDir() {
-			fileObjects, err := loadObjectsFromYAML(filePath)
+			f, err := loadFile(filePath)
 			if err != nil {
 				return nil, err
 			}
 
-			objects = append(objects, fileObjects...)
+			files = append(files, *f)
 		} else {
 			err := filepath.WalkDir(filePath, func(path string, d os.DirEntry, err error) error {
 				if err != nil {
@@ -61,12 +88,12 @@ func LoadObjectsFromFiles(filePaths []string) ([]unstructured.Unstructured, erro
 				}
 
 				if !d.IsDir() {
-					fileObjects, err := loadObjectsFromYAML(path)
+					f, err := loadFile(path)
 					if err != nil {
 						return err
 					}
 
-					objects = append(objects, fileObjects...)
+					files = append(files, *f)
 				}
 
 				return nil
@@ -77,17 +104,35 @@ func LoadObjectsFromFiles(filePaths []string) ([]unstructured.Unstructured, erro
 		}
 	}
 
-	return objects, nil
+	return files, nil
 }
 
-func loadObjectsFromYAML(yamlPath string) ([]unstructured.Unstructured, error) {
-	f, err := os.Open(yamlPath)
+func loadFile(filePath string) (*File, error) {
+	f, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	return loadObjectsFromReader(f)
+	return loadFileFromReader(filePath, f)
+}
+
+func loadFileFromReader(filePath string, reader io.Reader) (*File, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := loadObjectsFromReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		Path:    filePath,
+		Data:    data,
+		Objects: objects,
+	}, nil
 }
 
 func loadObjectsFromReader(reader io.Reader) ([]unstructured.Unstructured, error) {
@@ -19,6 +19,7 @@
 package loader_test
 
 import (
+	"path/filepath"
 	"testing"
 
 	"github.com/dpeckett/airgapify/internal/loader"
@@ -35,3 +36,14 @@ func TestLoadObjectsFromFiles(t *testing.T) {
 	assert.Equal(t, "v1", objects[0].GetAPIVersion())
 	assert.Equal(t, "Pod", objects[0].GetKind())
 }
+
+func TestLoadFiles(t *testing.T) {
+	files, err := loader.LoadFiles([]string{"testdata"})
+	require.NoError(t, err)
+
+	require.Len(t, files, 2)
+
+	assert.Equal(t, filepath.Join("testdata", "pod1.yaml"), files[0].Path)
+	assert.NotEmpty(t, files[0].Data)
+	assert.Len(t, files[0].Objects, 1)
+}
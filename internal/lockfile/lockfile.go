@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package lockfile
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	airgapifyv1alpha1 "github.com/dpeckett/airgapify/api/v1alpha1"
+	"github.com/dpeckett/airgapify/internal/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultPath is the default path of the lockfile.
+const DefaultPath = "airgapify.lock"
+
+// Resolve resolves each image reference to the digest of its manifest (or
+// index, for multi-platform images).
+func Resolve(ctx context.Context, images sets.String, registries *registry.Settings) (*airgapifyv1alpha1.ImageLock, error) {
+	lock := &airgapifyv1alpha1.ImageLock{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: airgapifyv1alpha1.GroupVersion.String(),
+			Kind:       "ImageLock",
+		},
+	}
+
+	resolved := make(map[string]string)
+	for _, image := range images.List() {
+		ref, err := registries.ParseReference(image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse image reference %q: %w", image, err)
+		}
+
+		if _, ok := resolved[ref.Name()]; ok {
+			continue
+		}
+
+		slog.Info("Resolving image", "image", image)
+
+		desc, err := remote.Get(ref, registries.RemoteOptions(ctx, ref.Context().Registry)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve image %q: %w", image, err)
+		}
+
+		resolved[ref.Name()] = desc.Digest.String()
+	}
+
+	for _, image := range sets.StringKeySet(resolved).List() {
+		lock.Spec.Images = append(lock.Spec.Images, airgapifyv1alpha1.ImageLockEntry{
+			Image:  image,
+			Digest: resolved[image],
+		})
+	}
+
+	return lock, nil
+}
+
+// Load reads a lockfile.
+func Load(path string) (*airgapifyv1alpha1.ImageLock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile: %w", err)
+	}
+
+	var lock airgapifyv1alpha1.ImageLock
+	if err := yaml.UnmarshalStrict(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lockfile: %w", err)
+	}
+
+	if lock.APIVersion != airgapifyv1alpha1.GroupVersion.String() || lock.Kind != "ImageLock" {
+		return nil, fmt.Errorf("%s is not an image lockfile", path)
+	}
+
+	return &lock, nil
+}
+
+// Write writes a lockfile. If path is "-" the lockfile is written to stdout.
+func Write(path string, lock *airgapifyv1alpha1.ImageLock) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(lock)
+	if err != nil {
+		return fmt.Errorf("failed to convert lockfile: %w", err)
+	}
+
+	// Omit the empty metadata (eg. "creationTimestamp: null").
+	unstructured.RemoveNestedField(obj, "metadata", "creationTimestamp")
+	if metadata, _, _ := unstructured.NestedMap(obj, "metadata"); len(metadata) == 0 {
+		unstructured.RemoveNestedField(obj, "metadata")
+	}
+
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lockfile: %w", err)
+	}
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+
+	return nil
+}
+
+// Digests returns the locked digest of each image reference, keyed by the
+// fully qualified reference name. It fails if any of the images are missing
+// from the lockfile.
+func Digests(lock *airgapifyv1alpha1.ImageLock, images sets.String, registries *registry.Settings) (map[string]v1.Hash, error) {
+	locked := make(map[string]v1.Hash)
+	for _, entry := range lock.Spec.Images {
+		digest, err := v1.NewHash(entry.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest for image %q: %w", entry.Image, err)
+		}
+
+		locked[entry.Image] = digest
+	}
+
+	digests := make(map[string]v1.Hash)
+	var missing []string
+	for _, image := range images.List() {
+		ref, err := registries.ParseReference(image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse image reference %q: %w", image, err)
+		}
+
+		digest, ok := locked[ref.Name()]
+		if !ok {
+			missing = append(missing, image)
+			continue
+		}
+
+		digests[ref.Name()] = digest
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("images missing from the lockfile (run lock to update it): %s", strings.Join(missing, ", "))
+	}
+
+	return digests, nil
+}
+
+// Drift is a difference between a lockfile and the current state of the
+// registries.
+type Drift struct {
+	// Image is the fully qualified image reference.
+	Image string `json:"image"`
+	// Locked is the digest in the lockfile (empty if the image is not locked).
+	Locked string `json:"locked,omitempty"`
+	// Current is the digest the reference currently resolves to (empty if the
+	// image is no longer referenced).
+	Current string `json:"current,omitempty"`
+}
+
+// Compare returns the images whose digests differ between a lockfile and a
+// freshly resolved one, ordered by reference.
+func Compare(locked, current *airgapifyv1alpha1.ImageLock) []Drift {
+	lockedDigests := make(map[string]string)
+	for _, entry := range locked.Spec.Images {
+		lockedDigests[entry.Image] = entry.Digest
+	}
+
+	currentDigests := make(map[string]string)
+	for _, entry := range current.Spec.Images {
+		currentDigests[entry.Image] = entry.Digest
+	}
+
+	var drift []Drift
+	for _, image := range sets.StringKeySet(lockedDigests).Union(sets.StringKeySet(currentDigests)).List() {
+		if lockedDigests[image] != currentDigests[image] {
+			drift = append(drift, Drift{
+				Image:   image,
+				Locked:  lockedDigests[image],
+				Current: currentDigests[image],
+			})
+		}
+	}
+
+	return drift
+}
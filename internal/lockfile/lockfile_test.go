@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package lockfile_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/dpeckett/airgapify/internal/lockfile"
+	"github.com/dpeckett/airgapify/internal/registry"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestLockfile(t *testing.T) {
+	s := httptest.NewServer(ggcrregistry.New())
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+
+	app, err := name.ParseReference(u.Host + "/team/app:v1")
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, remote.Write(app, img))
+
+	appDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	multiarch, err := name.ParseReference(u.Host + "/team/multiarch:v2")
+	require.NoError(t, err)
+
+	idx, err := random.Index(512, 1, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, remote.WriteIndex(multiarch, idx))
+
+	idxDigest, err := idx.Digest()
+	require.NoError(t, err)
+
+	registries, err := registry.NewSettings(nil)
+	require.NoError(t, err)
+
+	images := sets.NewString(app.String(), multiarch.String())
+
+	lock, err := lockfile.Resolve(context.Background(), images, registries)
+	require.NoError(t, err)
+
+	require.Len(t, lock.Spec.Images, 2)
+	assert.Equal(t, app.Name(), lock.Spec.Images[0].Image)
+	assert.Equal(t, appDigest.String(), lock.Spec.Images[0].Digest)
+	assert.Equal(t, multiarch.Name(), lock.Spec.Images[1].Image)
+	assert.Equal(t, idxDigest.String(), lock.Spec.Images[1].Digest)
+
+	lockPath := filepath.Join(t.TempDir(), lockfile.DefaultPath)
+	require.NoError(t, lockfile.Write(lockPath, lock))
+
+	loaded, err := lockfile.Load(lockPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, lock.Spec, loaded.Spec)
+
+	t.Run("Missing", func(t *testing.T) {
+		_, err := lockfile.Digests(loaded, images.Union(sets.NewString(u.Host+"/team/other:v1")), registries)
+		require.Error(t, err)
+
+		assert.Contains(t, err.Error(), "team/other:v1")
+	})
+
+	// Move the tag.
+	moved, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, remote.Write(app, moved))
+
+	movedDigest, err := moved.Digest()
+	require.NoError(t, err)
+
+	t.Run("Drift", func(t *testing.T) {
+		current, err := lockfile.Resolve(context.Background(), images, registries)
+		require.NoError(t, err)
+
+		assert.Equal(t, []lockfile.Drift{{
+			Image:   app.Name(),
+			Locked:  appDigest.String(),
+			Current: movedDigest.String(),
+		}}, lockfile.Compare(loaded, current))
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		digests, err := lockfile.Digests(loaded, images, registries)
+		require.NoError(t, err)
+
+		outputPath := filepath.Join(t.TempDir(), "images.tar")
+		err = archive.Create(context.Background(), outputPath, images, archive.CreateOptions{
+			Registries: registries,
+			Digests:    digests,
+		})
+		require.NoError(t, err)
+
+		a, err := archive.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, a.Close())
+		})
+
+		locked := make(map[string]string)
+		for _, desc := range a.Index().Manifests {
+			locked[desc.Annotations[archive.AnnotationRefName]] = desc.Digest.String()
+		}
+
+		// The original image, not the one the tag currently points to.
+		assert.Equal(t, appDigest.String(), locked[app.String()])
+	})
+}
@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package manifests prepares Kubernetes manifest files for use on the other
+// side of the air gap (eg. embedding them in an archive).
+package manifests
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+
+	"github.com/dpeckett/airgapify/api/v1alpha1"
+	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/dpeckett/airgapify/internal/extractor"
+	"github.com/dpeckett/airgapify/internal/loader"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Embed returns the manifest files to embed in an archive, optionally
+// rewriting their image references (if rewrite is not nil). Files are
+// numbered so that they can be applied in their original order.
+//
+// airgapify Config documents are left out, as they can contain registry
+// credentials (and aren't Kubernetes resources).
+func Embed(files []loader.File, e *extractor.ImageReferenceExtractor, rewrite extractor.RewriteFunc) ([]archive.ManifestFile, error) {
+	var manifests []archive.ManifestFile
+	for _, f := range files {
+		// Skip files without any Kubernetes resources (eg. only a Config).
+		if !slices.ContainsFunc(f.Objects, func(obj unstructured.Unstructured) bool { return !isConfig(obj) }) {
+			continue
+		}
+
+		data, err := withoutConfig(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove config from %s: %w", f.Path, err)
+		}
+
+		if rewrite != nil {
+			data, err = e.RewriteImageReferences(data, rewrite)
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewrite %s: %w", f.Path, err)
+			}
+		}
+
+		fileName := filepath.Base(f.Path)
+		if f.Path == "-" {
+			fileName = "stdin.yaml"
+		}
+
+		manifests = append(manifests, archive.ManifestFile{
+			Name: fmt.Sprintf("%03d-%s", len(manifests), fileName),
+			Data: data,
+		})
+	}
+
+	return manifests, nil
+}
+
+// isConfig returns whether an object is an airgapify Config resource.
+func isConfig(obj unstructured.Unstructured) bool {
+	return obj.GetAPIVersion() == v1alpha1.GroupVersion.String() && obj.GetKind() == "Config"
+}
+
+// withoutConfig returns the contents of a manifest file without any airgapify
+// Config documents. Files without a Config are returned unchanged, otherwise
+// the remaining documents are rejoined with plain document separators.
+func withoutConfig(f loader.File) ([]byte, error) {
+	if !slices.ContainsFunc(f.Objects, isConfig) {
+		return f.Data, nil
+	}
+
+	var docs [][]byte
+	r := yaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(f.Data)))
+	for {
+		doc, err := r.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		var obj map[string]any
+		if err := yaml.Unmarshal(doc, &obj); err != nil {
+			return nil, err
+		}
+
+		if isConfig(unstructured.Unstructured{Object: obj}) {
+			continue
+		}
+
+		docs = append(docs, doc)
+	}
+
+	return bytes.Join(docs, []byte("---\n")), nil
+}
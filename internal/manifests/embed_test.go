@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package manifests_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/dpeckett/airgapify/internal/extractor"
+	"github.com/dpeckett/airgapify/internal/loader"
+	"github.com/dpeckett/airgapify/internal/manifests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const deployment = `# The application.
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: nginx:1.25
+`
+
+const config = `apiVersion: airgapify.pecke.tt/v1alpha1
+kind: Config
+metadata:
+  name: airgapify-config
+spec:
+  registries:
+  - host: registry.internal.example.com
+    auth:
+      username:
+        value: airgapify
+      password:
+        value: hunter2
+`
+
+func TestEmbed(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.yaml"), []byte(deployment+"---\n"+config), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(config), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "service.yaml"), []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: app\n"), 0o644))
+
+	files, err := loader.LoadFiles([]string{dir})
+	require.NoError(t, err)
+
+	e := extractor.NewImageReferenceExtractor(extractor.DefaultRules)
+
+	t.Run("Config", func(t *testing.T) {
+		embedded, err := manifests.Embed(files, e, nil)
+		require.NoError(t, err)
+
+		require.Len(t, embedded, 2)
+
+		assert.Equal(t, "000-app.yaml", embedded[0].Name)
+		assert.Equal(t, deployment, string(embedded[0].Data))
+		assert.Equal(t, "001-service.yaml", embedded[1].Name)
+
+		// Make sure the credentials don't end up in the archive.
+		outputPath := filepath.Join(t.TempDir(), "images.tar")
+
+		err = archive.Create(context.Background(), outputPath, sets.NewString(), archive.CreateOptions{
+			Manifests: embedded,
+		})
+		require.NoError(t, err)
+
+		extracted, err := archive.ExtractManifests(outputPath)
+		require.NoError(t, err)
+
+		for _, m := range extracted {
+			assert.NotContains(t, string(m.Data), "hunter2", m.Name)
+			assert.NotContains(t, string(m.Data), "kind: Config", m.Name)
+		}
+	})
+
+	t.Run("Rewrite", func(t *testing.T) {
+		embedded, err := manifests.Embed(files, e, func(image string) (string, error) {
+			return "registry.internal.example.com/" + image, nil
+		})
+		require.NoError(t, err)
+
+		require.Len(t, embedded, 2)
+
+		assert.Contains(t, string(embedded[0].Data), "image: registry.internal.example.com/nginx:1.25\n")
+		assert.NotContains(t, string(embedded[0].Data), "hunter2")
+	})
+}
@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package manifests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/dpeckett/airgapify/internal/extractor"
+	"github.com/dpeckett/airgapify/internal/loader"
+	"github.com/dpeckett/airgapify/internal/mirror"
+	"github.com/dpeckett/airgapify/internal/registry"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// DigestResolver returns the digest of an image, given its original (src) and
+// rewritten (dst) references.
+type DigestResolver func(src, dst name.Reference) (v1.Hash, error)
+
+// ArchiveDigests resolves digests from the index of an archive, by the
+// original reference name.
+func ArchiveDigests(a *archive.Archive) DigestResolver {
+	digests := make(map[string]v1.Hash)
+	for _, desc := range a.Index().Manifests {
+		if ref, err := name.ParseReference(desc.Annotations[archive.AnnotationRefName]); err == nil {
+			digests[ref.Name()] = desc.Digest
+		}
+	}
+
+	return func(src, _ name.Reference) (v1.Hash, error) {
+		digest, ok := digests[src.Name()]
+		if !ok {
+			return v1.Hash{}, errors.New("image not found in archive")
+		}
+
+		return digest, nil
+	}
+}
+
+// RegistryDigests resolves digests from the registry the images have been
+// pushed to, by the rewritten reference.
+func RegistryDigests(ctx context.Context, registries *registry.Settings) DigestResolver {
+	return func(_, dst name.Reference) (v1.Hash, error) {
+		desc, err := remote.Head(dst, registries.RemoteOptions(ctx, dst.Context().Registry)...)
+		if err != nil {
+			return v1.Hash{}, err
+		}
+
+		return desc.Digest, nil
+	}
+}
+
+// ImageRewriter returns a function that rewrites image references to point at
+// the target registry (with the same repository paths as when pushing). If
+// resolveDigest is not nil, tagged references are also pinned to the digest
+// it returns.
+func ImageRewriter(registries *registry.Settings, target string, resolveDigest DigestResolver) extractor.RewriteFunc {
+	return func(image string) (string, error) {
+		src, err := registries.ParseReference(image)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse image reference %q: %w", image, err)
+		}
+
+		rewritten, err := mirror.Destination(src, target)
+		if err != nil {
+			return "", err
+		}
+
+		if _, ok := src.(name.Tag); !ok || resolveDigest == nil {
+			return rewritten, nil
+		}
+
+		dst, err := registries.ParseReference(rewritten)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse image reference %q: %w", rewritten, err)
+		}
+
+		digest, err := resolveDigest(src, dst)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve digest of %q: %w", image, err)
+		}
+
+		return rewritten + "@" + digest.String(), nil
+	}
+}
+
+// RewriteOptions are options for rewriting manifest files.
+type RewriteOptions struct {
+	// Output is the directory to write the rewritten files to, or "-" to write
+	// them to stdout as a single stream.
+	Output string
+	// InPlace overwrites the original files (instead of writing to Output).
+	InPlace bool
+}
+
+// Rewrite rewrites the image references in manifest files (leaving everything
+// else untouched), and writes the rewritten files out. Files without any
+// Kubernetes resources are skipped.
+func Rewrite(files []loader.File, e *extractor.ImageReferenceExtractor, rewrite extractor.RewriteFunc, opts RewriteOptions) error {
+	if !opts.InPlace && opts.Output != "-" {
+		if err := os.MkdirAll(opts.Output, 0o755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+
+	written := sets.NewString()
+	for _, f := range files {
+		if len(f.Objects) == 0 {
+			continue
+		}
+
+		data, err := e.RewriteImageReferences(f.Data, rewrite)
+		if err != nil {
+			return fmt.Errorf("failed to rewrite %s: %w", f.Path, err)
+		}
+
+		switch {
+		case opts.InPlace:
+			if f.Path == "-" {
+				return errors.New("cannot rewrite stdin in place")
+			}
+
+			// Keep the permissions of the original file.
+			fi, err := os.Stat(f.Path)
+			if err != nil {
+				return err
+			}
+
+			if err := os.WriteFile(f.Path, data, fi.Mode().Perm()); err != nil {
+				return fmt.Errorf("failed to write %s: %w", f.Path, err)
+			}
+		case opts.Output == "-":
+			if written.Len() > 0 {
+				fmt.Fprintln(os.Stdout, "---")
+			}
+			written.Insert(f.Path)
+
+			if _, err := os.Stdout.Write(data); err != nil {
+				return err
+			}
+
+			if !bytes.HasSuffix(data, []byte("\n")) {
+				fmt.Fprintln(os.Stdout)
+			}
+		default:
+			fileName := filepath.Base(f.Path)
+			if f.Path == "-" {
+				fileName = "stdin.yaml"
+			}
+
+			if written.Has(fileName) {
+				return fmt.Errorf("multiple manifests named %q", fileName)
+			}
+			written.Insert(fileName)
+
+			if err := os.WriteFile(filepath.Join(opts.Output, fileName), data, 0o644); err != nil {
+				return fmt.Errorf("failed to write manifest: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package manifests_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/dpeckett/airgapify/internal/extractor"
+	"github.com/dpeckett/airgapify/internal/loader"
+	"github.com/dpeckett/airgapify/internal/manifests"
+	airgapifyregistry "github.com/dpeckett/airgapify/internal/registry"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestRewrite(t *testing.T) {
+	srcHost := startRegistry(t)
+	dstHost := startRegistry(t)
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	src, err := name.ParseReference(srcHost + "/team/app:v1")
+	require.NoError(t, err)
+
+	require.NoError(t, remote.Write(src, img))
+
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	// The image has already been pushed to the internal registry.
+	dst, err := name.ParseReference(dstHost + "/mirror/team/app:v1")
+	require.NoError(t, err)
+
+	require.NoError(t, remote.Write(dst, img))
+
+	archivePath := filepath.Join(t.TempDir(), "images.tar")
+	require.NoError(t, archive.Create(context.Background(), archivePath, sets.NewString(src.String()), archive.CreateOptions{}))
+
+	a, err := archive.Open(archivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+	})
+
+	manifestsDir := t.TempDir()
+
+	pod := "# The application.\napiVersion: v1\nkind: Pod\nmetadata:\n  name: app\nspec:\n  containers:\n  - name: app\n    image: " + src.String() + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(manifestsDir, "pod.yaml"), []byte(pod), 0o644))
+
+	files, err := loader.LoadFiles([]string{manifestsDir})
+	require.NoError(t, err)
+
+	registries, err := airgapifyregistry.NewSettings(nil)
+	require.NoError(t, err)
+
+	e := extractor.NewImageReferenceExtractor(extractor.DefaultRules)
+
+	tests := []struct {
+		name          string
+		resolveDigest manifests.DigestResolver
+		expected      string
+	}{
+		{
+			name:     "Tags",
+			expected: dst.String(),
+		},
+		{
+			name:          "Pin Digests From Archive",
+			resolveDigest: manifests.ArchiveDigests(a),
+			expected:      dst.String() + "@" + digest.String(),
+		},
+		{
+			name:          "Pin Digests From Registry",
+			resolveDigest: manifests.RegistryDigests(context.Background(), registries),
+			expected:      dst.String() + "@" + digest.String(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputDir := filepath.Join(t.TempDir(), "rewritten")
+
+			rewrite := manifests.ImageRewriter(registries, dstHost+"/mirror", tt.resolveDigest)
+			require.NoError(t, manifests.Rewrite(files, e, rewrite, manifests.RewriteOptions{
+				Output: outputDir,
+			}))
+
+			rewritten, err := os.ReadFile(filepath.Join(outputDir, "pod.yaml"))
+			require.NoError(t, err)
+
+			// Only the image reference is changed.
+			assert.Equal(t, "# The application.\napiVersion: v1\nkind: Pod\nmetadata:\n  name: app\nspec:\n  containers:\n  - name: app\n    image: "+tt.expected+"\n", string(rewritten))
+		})
+	}
+
+	t.Run("Missing From Archive", func(t *testing.T) {
+		other, err := name.ParseReference(srcHost + "/team/other:v1")
+		require.NoError(t, err)
+
+		rewrite := manifests.ImageRewriter(registries, dstHost+"/mirror", manifests.ArchiveDigests(a))
+
+		_, err = rewrite(other.String())
+		require.Error(t, err)
+	})
+
+	t.Run("In Place", func(t *testing.T) {
+		dir := t.TempDir()
+
+		path := filepath.Join(dir, "pod.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(pod), 0o600))
+
+		files, err := loader.LoadFiles([]string{dir})
+		require.NoError(t, err)
+
+		rewrite := manifests.ImageRewriter(registries, dstHost+"/mirror", nil)
+		require.NoError(t, manifests.Rewrite(files, e, rewrite, manifests.RewriteOptions{
+			InPlace: true,
+		}))
+
+		rewritten, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		assert.Contains(t, string(rewritten), "image: "+dst.String()+"\n")
+
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+
+		assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	})
+
+	t.Run("Duplicate Names", func(t *testing.T) {
+		duplicated := append(slices.Clone(files), loader.File{Path: filepath.Join("other", "pod.yaml"), Data: []byte(pod), Objects: files[0].Objects})
+
+		rewrite := manifests.ImageRewriter(registries, dstHost+"/mirror", nil)
+		err := manifests.Rewrite(duplicated, e, rewrite, manifests.RewriteOptions{
+			Output: t.TempDir(),
+		})
+		require.Error(t, err)
+	})
+}
+
+func startRegistry(t *testing.T) string {
+	s := httptest.NewServer(registry.New())
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+
+	return u.Host
+}
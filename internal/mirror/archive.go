@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// PushArchive copies the images (and artifacts) in an archive to the target,
+// using the same repository paths as Push. Indexes are copied in their
+// entirety, and blobs and manifests that already exist in the target are
+// skipped. Entries in the archive's index without a reference name are skipped.
+func PushArchive(ctx context.Context, a *archive.Archive, target string, opts Options) ([]Mapping, error) {
+	var mappings []Mapping
+
+	for _, desc := range a.Index().Manifests {
+		refName, ok := desc.Annotations[archive.AnnotationRefName]
+		if !ok {
+			slog.Warn("Skipping image without a reference name", "digest", desc.Digest)
+			continue
+		}
+
+		src, err := name.ParseReference(refName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse reference name %q: %w", refName, err)
+		}
+
+		dstName, err := Destination(src, target)
+		if err != nil {
+			return nil, err
+		}
+
+		dst, err := opts.Registries.ParseReference(dstName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse destination reference %q: %w", dstName, err)
+		}
+
+		// Archives built for a single platform hold the platform image rather
+		// than the index a digest reference points to.
+		dst, err = withDigest(dst, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		slog.Info("Pushing image", "image", refName, "destination", dst.String())
+
+		if err := pushDescriptor(ctx, a, desc, refName, dst, opts); err != nil {
+			return nil, fmt.Errorf("failed to push image %q: %w", refName, err)
+		}
+
+		mappings = append(mappings, Mapping{
+			Source:      refName,
+			Destination: dst.String(),
+		})
+	}
+
+	return mappings, nil
+}
+
+func pushDescriptor(ctx context.Context, a *archive.Archive, desc v1.Descriptor, refName string, dst name.Reference, opts Options) error {
+	dstOpts := opts.Registries.RemoteOptions(ctx, dst.Context().Registry)
+	dst = pushTarget(dst)
+
+	if exists(dst, desc.Digest, dstOpts) {
+		slog.Info("Image already exists", "destination", dst.String())
+		return nil
+	}
+
+	if desc.MediaType.IsIndex() {
+		ii, err := a.ImageIndex(desc)
+		if err != nil {
+			return err
+		}
+
+		return remote.WriteIndex(dst, ii, dstOpts...)
+	}
+
+	img, err := a.Image(desc)
+	if err != nil {
+		return err
+	}
+
+	return remote.Write(dst, opts.Progress.WrapImage(refName, img), dstOpts...)
+}
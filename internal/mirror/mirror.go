@@ -0,0 +1,216 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/dpeckett/airgapify/internal/progress"
+	"github.com/dpeckett/airgapify/internal/registry"
+	"github.com/dpeckett/airgapify/internal/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Options are options for mirroring images to a target registry.
+type Options struct {
+	// Platform is the target platform, if nil multi-platform images are
+	// copied in their entirety.
+	Platform *v1.Platform
+	// Registries holds per-registry connection settings (for both the source
+	// and target registries).
+	Registries *registry.Settings
+	// Progress reports the progress of layer uploads (optional).
+	Progress *progress.Reporter
+	// Digests pins images (keyed by fully qualified reference name) to
+	// manifest digests, eg. from a lockfile. If set, images are fetched by
+	// digest, and every image must have an entry.
+	Digests map[string]v1.Hash
+}
+
+// Mapping records where an image was copied to.
+type Mapping struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// Destination returns the reference of an image once it has been copied to
+// the target, where target is a registry host optionally followed by a
+// repository prefix (eg. "registry.example.com/mirror"). The original
+// repository path and tag (or digest) are preserved.
+func Destination(src name.Reference, target string) (string, error) {
+	target = strings.TrimSuffix(target, "/")
+	if target == "" {
+		return "", fmt.Errorf("invalid target registry %q", target)
+	}
+
+	repo := target + "/" + src.Context().RepositoryStr()
+
+	switch ref := src.(type) {
+	case name.Tag:
+		return repo + ":" + ref.TagStr(), nil
+	case name.Digest:
+		if tag, ok := util.ReferenceTag(ref); ok {
+			return repo + ":" + tag.TagStr() + "@" + ref.DigestStr(), nil
+		}
+
+		return repo + "@" + ref.DigestStr(), nil
+	default:
+		return "", fmt.Errorf("unsupported reference type %T", src)
+	}
+}
+
+// Push copies a set of images from their source registries to the target.
+// Blobs and manifests that already exist in the target are skipped.
+func Push(ctx context.Context, images sets.String, target string, opts Options) ([]Mapping, error) {
+	var mappings []Mapping
+
+	for _, image := range images.List() {
+		src, err := opts.Registries.ParseReference(image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse image reference %q: %w", image, err)
+		}
+
+		dstName, err := Destination(src, target)
+		if err != nil {
+			return nil, err
+		}
+
+		dst, err := opts.Registries.ParseReference(dstName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse destination reference %q: %w", dstName, err)
+		}
+
+		fetch := src
+		if opts.Digests != nil {
+			digest, ok := opts.Digests[src.Name()]
+			if !ok {
+				return nil, fmt.Errorf("image %q is missing from the lockfile", image)
+			}
+
+			fetch = src.Context().Digest(digest.String())
+		}
+
+		slog.Info("Copying image", "source", src.String(), "destination", dst.String())
+
+		dst, err = copyImage(ctx, fetch, dst, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy image %q: %w", image, err)
+		}
+
+		mappings = append(mappings, Mapping{
+			Source:      src.String(),
+			Destination: dst.String(),
+		})
+	}
+
+	return mappings, nil
+}
+
+// copyImage copies a single image, returning the (possibly updated)
+// destination reference.
+func copyImage(ctx context.Context, src, dst name.Reference, opts Options) (name.Reference, error) {
+	srcOpts := opts.Registries.RemoteOptions(ctx, src.Context().Registry)
+	dstOpts := opts.Registries.RemoteOptions(ctx, dst.Context().Registry)
+
+	desc, err := remote.Get(src, srcOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if desc.MediaType.IsIndex() && opts.Platform == nil {
+		target := pushTarget(dst)
+		if exists(target, desc.Digest, dstOpts) {
+			slog.Info("Image already exists", "destination", dst.String())
+			return dst, nil
+		}
+
+		ii, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+
+		return dst, remote.WriteIndex(target, ii, dstOpts...)
+	}
+
+	if opts.Platform != nil {
+		srcOpts = append(srcOpts, remote.WithPlatform(*opts.Platform))
+	}
+
+	img, err := remote.Image(src, srcOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	// Selecting a platform from an index changes the digest.
+	dst, err = withDigest(dst, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	target := pushTarget(dst)
+	if exists(target, digest, dstOpts) {
+		slog.Info("Image already exists", "destination", dst.String())
+		return dst, nil
+	}
+
+	return dst, remote.Write(target, opts.Progress.WrapImage(src.String(), img), dstOpts...)
+}
+
+// withDigest replaces the digest of a destination reference by digest (keeping
+// any tag), eg. when the image pushed is a single platform of the index the
+// reference originally pointed to. Other references are returned unchanged.
+func withDigest(dst name.Reference, digest v1.Hash) (name.Reference, error) {
+	if _, ok := dst.(name.Digest); !ok {
+		return dst, nil
+	}
+
+	if tag, ok := util.ReferenceTag(dst); ok {
+		return name.NewDigest(tag.Name() + "@" + digest.String())
+	}
+
+	return dst.Context().Digest(digest.String()), nil
+}
+
+// pushTarget returns the reference to push an image to. Images referenced by
+// both tag and digest are pushed by tag (the digest is the same either way),
+// as pushing by digest alone would lose the tag.
+func pushTarget(dst name.Reference) name.Reference {
+	if tag, ok := util.ReferenceTag(dst); ok {
+		return tag
+	}
+
+	return dst
+}
+
+// exists checks if the destination reference already points to the given digest.
+func exists(dst name.Reference, digest v1.Hash, opts []remote.Option) bool {
+	desc, err := remote.Head(dst, opts...)
+	return err == nil && desc.Digest == digest
+}
@@ -0,0 +1,325 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mirror_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/dpeckett/airgapify/internal/mirror"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestDestination(t *testing.T) {
+	tag, err := name.ParseReference("nginx:1.25")
+	require.NoError(t, err)
+
+	dst, err := mirror.Destination(tag, "registry.example.com/mirror/")
+	require.NoError(t, err)
+
+	assert.Equal(t, "registry.example.com/mirror/library/nginx:1.25", dst)
+
+	digest, err := name.ParseReference("quay.io/prometheus/prometheus@sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	require.NoError(t, err)
+
+	dst, err = mirror.Destination(digest, "registry.example.com")
+	require.NoError(t, err)
+
+	assert.Equal(t, "registry.example.com/prometheus/prometheus@sha256:0000000000000000000000000000000000000000000000000000000000000000", dst)
+
+	tagDigest, err := name.ParseReference("registry.lab:5000/team/app:v1@sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	require.NoError(t, err)
+
+	dst, err = mirror.Destination(tagDigest, "registry.example.com")
+	require.NoError(t, err)
+
+	assert.Equal(t, "registry.example.com/team/app:v1@sha256:0000000000000000000000000000000000000000000000000000000000000000", dst)
+}
+
+func TestPush(t *testing.T) {
+	srcHost := startRegistry(t)
+
+	var writes atomic.Int64
+	dstHost := startRegistryWithHandler(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				writes.Add(1)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	src, err := name.ParseReference(srcHost + "/team/app:v1")
+	require.NoError(t, err)
+
+	require.NoError(t, remote.Write(src, img))
+
+	expectedDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	// The same image, referenced by a (different) tag and digest.
+	srcPinned, err := name.ParseReference(srcHost + "/team/app:pinned@" + expectedDigest.String())
+	require.NoError(t, err)
+
+	idx, err := random.Index(512, 1, 2)
+	require.NoError(t, err)
+
+	srcIndex, err := name.ParseReference(srcHost + "/team/multiarch:v2")
+	require.NoError(t, err)
+
+	require.NoError(t, remote.WriteIndex(srcIndex, idx))
+
+	images := sets.NewString(src.String(), srcPinned.String(), srcIndex.String())
+
+	// Pushing twice should be a no-op the second time.
+	for i := 0; i < 2; i++ {
+		writes.Store(0)
+
+		mappings, err := mirror.Push(context.Background(), images, dstHost+"/mirror", mirror.Options{})
+		require.NoError(t, err)
+
+		assert.Equal(t, []mirror.Mapping{
+			{Source: srcPinned.String(), Destination: dstHost + "/mirror/team/app:pinned@" + expectedDigest.String()},
+			{Source: src.String(), Destination: dstHost + "/mirror/team/app:v1"},
+			{Source: srcIndex.String(), Destination: dstHost + "/mirror/team/multiarch:v2"},
+		}, mappings)
+
+		if i == 0 {
+			assert.NotZero(t, writes.Load())
+		} else {
+			assert.Zero(t, writes.Load())
+		}
+	}
+
+	for _, tag := range []string{"v1", "pinned"} {
+		dst, err := name.ParseReference(dstHost + "/mirror/team/app:" + tag)
+		require.NoError(t, err)
+
+		desc, err := remote.Head(dst)
+		require.NoError(t, err)
+
+		assert.Equal(t, expectedDigest, desc.Digest)
+	}
+
+	dstIndex, err := name.ParseReference(dstHost + "/mirror/team/multiarch:v2")
+	require.NoError(t, err)
+
+	desc, err := remote.Head(dstIndex)
+	require.NoError(t, err)
+
+	expectedDigest, err = idx.Digest()
+	require.NoError(t, err)
+
+	assert.Equal(t, expectedDigest, desc.Digest)
+}
+
+func TestPushPlatform(t *testing.T) {
+	srcHost := startRegistry(t)
+
+	var manifestPuts []string
+	dstHost := startRegistryWithHandler(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+				manifestPuts = append(manifestPuts, r.URL.Path)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	amd64, err := random.Image(1024, 1)
+	require.NoError(t, err)
+
+	arm64, err := random.Image(1024, 1)
+	require.NoError(t, err)
+
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+	)
+
+	srcTag, err := name.ParseReference(srcHost + "/team/multiarch:v2")
+	require.NoError(t, err)
+
+	require.NoError(t, remote.WriteIndex(srcTag, idx))
+
+	indexDigest, err := idx.Digest()
+	require.NoError(t, err)
+
+	// A reference pinned to the index digest.
+	src := srcTag.Context().Digest(indexDigest.String())
+
+	mappings, err := mirror.Push(context.Background(), sets.NewString(src.String()), dstHost+"/mirror", mirror.Options{
+		Platform: &v1.Platform{OS: "linux", Architecture: "arm64"},
+	})
+	require.NoError(t, err)
+
+	expectedDigest, err := arm64.Digest()
+	require.NoError(t, err)
+
+	// The destination is pinned to the digest of the selected platform.
+	expectedDst := dstHost + "/mirror/team/multiarch@" + expectedDigest.String()
+	assert.Equal(t, []mirror.Mapping{{Source: src.String(), Destination: expectedDst}}, mappings)
+
+	dst, err := name.ParseReference(expectedDst)
+	require.NoError(t, err)
+
+	pulled, err := remote.Image(dst)
+	require.NoError(t, err)
+
+	require.NoError(t, validate.Image(pulled))
+
+	// Nothing should have been pushed under the digest of the index.
+	assert.NotContains(t, manifestPuts, "/v2/mirror/team/multiarch/manifests/"+indexDigest.String())
+}
+
+func TestPushArchive(t *testing.T) {
+	dstHost := startRegistry(t)
+
+	dir := t.TempDir()
+
+	p, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, p.AppendImage(img, layout.WithAnnotations(map[string]string{
+		archive.AnnotationRefName: "docker.io/team/app:v1",
+	})))
+
+	idx, err := random.Index(512, 1, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, p.AppendIndex(idx, layout.WithAnnotations(map[string]string{
+		archive.AnnotationRefName: "quay.io/team/multiarch:v2",
+	})))
+
+	indexDigest, err := idx.Digest()
+	require.NoError(t, err)
+
+	idxManifest, err := idx.IndexManifest()
+	require.NoError(t, err)
+
+	// A single platform of an index, archived for a reference pinned to the
+	// digest of the index.
+	platformDigest := idxManifest.Manifests[0].Digest
+
+	platformImg, err := idx.Image(platformDigest)
+	require.NoError(t, err)
+
+	require.NoError(t, p.AppendImage(platformImg, layout.WithAnnotations(map[string]string{
+		archive.AnnotationRefName: "quay.io/team/multiarch:v3@" + indexDigest.String(),
+	})))
+
+	a, err := archive.Open(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+	})
+
+	// Pushing twice should be a no-op the second time.
+	for i := 0; i < 2; i++ {
+		mappings, err := mirror.PushArchive(context.Background(), a, dstHost+"/mirror", mirror.Options{})
+		require.NoError(t, err)
+
+		assert.Equal(t, []mirror.Mapping{
+			{Source: "docker.io/team/app:v1", Destination: dstHost + "/mirror/team/app:v1"},
+			{Source: "quay.io/team/multiarch:v2", Destination: dstHost + "/mirror/team/multiarch:v2"},
+			{Source: "quay.io/team/multiarch:v3@" + indexDigest.String(), Destination: dstHost + "/mirror/team/multiarch:v3@" + platformDigest.String()},
+		}, mappings)
+	}
+
+	dst, err := name.ParseReference(dstHost + "/mirror/team/app:v1")
+	require.NoError(t, err)
+
+	pulled, err := remote.Image(dst)
+	require.NoError(t, err)
+
+	// Check the layers were uploaded too.
+	require.NoError(t, validate.Image(pulled))
+
+	expectedDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	digest, err := pulled.Digest()
+	require.NoError(t, err)
+
+	assert.Equal(t, expectedDigest, digest)
+
+	dstIndex, err := name.ParseReference(dstHost + "/mirror/team/multiarch:v2")
+	require.NoError(t, err)
+
+	pulledIndex, err := remote.Index(dstIndex)
+	require.NoError(t, err)
+
+	require.NoError(t, validate.Index(pulledIndex))
+
+	digest, err = pulledIndex.Digest()
+	require.NoError(t, err)
+
+	assert.Equal(t, indexDigest, digest)
+
+	dstPinned, err := name.ParseReference(dstHost + "/mirror/team/multiarch:v3@" + platformDigest.String())
+	require.NoError(t, err)
+
+	pulled, err = remote.Image(dstPinned)
+	require.NoError(t, err)
+
+	require.NoError(t, validate.Image(pulled))
+}
+
+func startRegistry(t *testing.T) string {
+	return startRegistryWithHandler(t, func(next http.Handler) http.Handler {
+		return next
+	})
+}
+
+// startRegistryWithHandler starts an in-memory registry, with its handler
+// wrapped by the given middleware.
+func startRegistryWithHandler(t *testing.T, middleware func(http.Handler) http.Handler) string {
+	s := httptest.NewServer(middleware(registry.New()))
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+
+	return u.Host
+}
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package progress
+
+import (
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// WrapImage wraps an image so that the progress of reading its layers is
+// reported.
+func (r *Reporter) WrapImage(name string, img v1.Image) v1.Image {
+	if r == nil {
+		return img
+	}
+
+	return &image{Image: img, name: name, r: r}
+}
+
+type image struct {
+	v1.Image
+	name string
+	r    *Reporter
+}
+
+func (img *image) Layers() ([]v1.Layer, error) {
+	layers, err := img.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := make([]v1.Layer, len(layers))
+	for i, l := range layers {
+		wrapped[i] = &layer{Layer: l, image: img}
+	}
+
+	return wrapped, nil
+}
+
+func (img *image) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := img.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return &layer{Layer: l, image: img}, nil
+}
+
+type layer struct {
+	v1.Layer
+	image *image
+}
+
+func (l *layer) Compressed() (io.ReadCloser, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := l.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.image.r.Track(l.image.name, digest, size, rc), nil
+}
@@ -0,0 +1,366 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dpeckett/airgapify/internal/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Mode is how progress is reported.
+type Mode string
+
+const (
+	// ModeAuto renders a live display if the output is a terminal, and
+	// structured JSON events otherwise.
+	ModeAuto Mode = "auto"
+	// ModeTerminal renders a live terminal display.
+	ModeTerminal Mode = "tty"
+	// ModeJSON writes periodic progress events as JSON lines.
+	ModeJSON Mode = "json"
+	// ModeNone disables progress reporting.
+	ModeNone Mode = "none"
+)
+
+// Event is a structured progress event.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Image      string    `json:"image"`
+	Layer      string    `json:"layer"`
+	BytesDone  int64     `json:"bytesDone"`
+	BytesTotal int64     `json:"bytesTotal"`
+	// Rate is the average transfer rate in bytes per second.
+	Rate int64 `json:"rate"`
+	Done bool  `json:"done"`
+}
+
+// Reporter reports the progress of layer downloads.
+type Reporter struct {
+	out      *os.File
+	terminal bool
+	interval time.Duration
+
+	mu        sync.Mutex
+	layers    []*layerProgress
+	drawn     int
+	prevLog   *slog.Logger
+	stop      chan struct{}
+	stoppedCh chan struct{}
+}
+
+type layerProgress struct {
+	image   string
+	digest  v1.Hash
+	total   int64
+	done    int64
+	started time.Time
+}
+
+// ResolveMode returns the mode progress will be reported in when writing to
+// out, resolving ModeAuto to ModeTerminal or ModeJSON.
+func ResolveMode(out *os.File, mode Mode) (Mode, error) {
+	switch mode {
+	case ModeAuto, "":
+		fi, err := out.Stat()
+		if err != nil {
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeCharDevice != 0 {
+			return ModeTerminal, nil
+		}
+
+		return ModeJSON, nil
+	case ModeTerminal, ModeJSON, ModeNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown progress mode %q", mode)
+	}
+}
+
+// NewReporter creates a new progress reporter writing to out. Returns nil if
+// progress reporting is disabled (a nil reporter is valid, and does nothing).
+func NewReporter(out *os.File, mode Mode) (*Reporter, error) {
+	mode, err := ResolveMode(out, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == ModeNone {
+		return nil, nil
+	}
+
+	r := &Reporter{
+		out:      out,
+		terminal: mode == ModeTerminal,
+		interval: 10 * time.Second,
+	}
+
+	if r.terminal {
+		r.interval = 200 * time.Millisecond
+	}
+
+	return r, nil
+}
+
+// Start begins periodically reporting progress, until the context is
+// cancelled or Stop is called. In terminal mode the default logger is
+// replaced, so that log records are not clobbered by the live display.
+func (r *Reporter) Start(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	r.stop = make(chan struct{})
+	r.stoppedCh = make(chan struct{})
+
+	if r.terminal {
+		r.prevLog = slog.Default()
+		slog.SetDefault(slog.New(&logHandler{Handler: r.prevLog.Handler(), r: r}))
+	}
+
+	go func() {
+		defer close(r.stoppedCh)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.mu.Lock()
+				r.report()
+				r.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Stop stops reporting progress.
+func (r *Reporter) Stop() {
+	if r == nil || r.stop == nil {
+		return
+	}
+
+	close(r.stop)
+	<-r.stoppedCh
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.terminal {
+		r.clear()
+		slog.SetDefault(r.prevLog)
+	}
+}
+
+// Track wraps a reader of a layer so that its progress is reported.
+func (r *Reporter) Track(image string, digest v1.Hash, total int64, rc io.ReadCloser) io.ReadCloser {
+	if r == nil {
+		return rc
+	}
+
+	lp := &layerProgress{
+		image:   image,
+		digest:  digest,
+		total:   total,
+		started: time.Now(),
+	}
+
+	r.mu.Lock()
+	r.layers = append(r.layers, lp)
+	r.mu.Unlock()
+
+	return &trackingReader{ReadCloser: rc, r: r, lp: lp}
+}
+
+func (r *Reporter) update(lp *layerProgress, n int) {
+	r.mu.Lock()
+	lp.done += int64(n)
+	r.mu.Unlock()
+}
+
+func (r *Reporter) finish(lp *layerProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, other := range r.layers {
+		if other == lp {
+			r.layers = append(r.layers[:i], r.layers[i+1:]...)
+			break
+		}
+	}
+
+	// Layers that were never read (eg. because the blob already existed) are
+	// not interesting.
+	if lp.done == 0 {
+		return
+	}
+
+	if r.terminal {
+		r.clear()
+		fmt.Fprintln(r.out, formatLine(lp, true))
+		r.draw()
+	} else {
+		r.writeEvent(lp, true)
+	}
+}
+
+// report must be called with the mutex held.
+func (r *Reporter) report() {
+	if r.terminal {
+		r.clear()
+		r.draw()
+		return
+	}
+
+	for _, lp := range r.layers {
+		r.writeEvent(lp, false)
+	}
+}
+
+func (r *Reporter) writeEvent(lp *layerProgress, done bool) {
+	_ = json.NewEncoder(r.out).Encode(Event{
+		Time:       time.Now().UTC(),
+		Image:      lp.image,
+		Layer:      lp.digest.String(),
+		BytesDone:  lp.done,
+		BytesTotal: lp.total,
+		Rate:       lp.rate(),
+		Done:       done,
+	})
+}
+
+// draw renders the live display, must be called with the mutex held.
+func (r *Reporter) draw() {
+	var sb strings.Builder
+	for _, lp := range r.layers {
+		sb.WriteString(formatLine(lp, false))
+		sb.WriteByte('\n')
+	}
+
+	_, _ = io.WriteString(r.out, sb.String())
+	r.drawn = len(r.layers)
+}
+
+// clear erases the live display, must be called with the mutex held.
+func (r *Reporter) clear() {
+	if r.drawn > 0 {
+		fmt.Fprintf(r.out, "\x1b[%dA\x1b[J", r.drawn)
+		r.drawn = 0
+	}
+}
+
+func (lp *layerProgress) rate() int64 {
+	elapsed := time.Since(lp.started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return int64(float64(lp.done) / elapsed)
+}
+
+func formatLine(lp *layerProgress, done bool) string {
+	const barWidth = 30
+
+	var bar string
+	if done {
+		bar = strings.Repeat("=", barWidth)
+	} else if lp.total > 0 {
+		filled := int(float64(barWidth) * float64(lp.done) / float64(lp.total))
+		filled = min(filled, barWidth)
+		bar = strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+	} else {
+		bar = strings.Repeat(" ", barWidth)
+	}
+
+	return fmt.Sprintf("%s %s [%s] %s / %s (%s/s)", lp.image, shortDigest(lp.digest), bar,
+		util.FormatBytes(lp.done), util.FormatBytes(lp.total), util.FormatBytes(lp.rate()))
+}
+
+func shortDigest(h v1.Hash) string {
+	if len(h.Hex) > 12 {
+		return h.Hex[:12]
+	}
+
+	return h.Hex
+}
+
+type trackingReader struct {
+	io.ReadCloser
+	r    *Reporter
+	lp   *layerProgress
+	once sync.Once
+}
+
+func (tr *trackingReader) Read(p []byte) (int, error) {
+	n, err := tr.ReadCloser.Read(p)
+	if n > 0 {
+		tr.r.update(tr.lp, n)
+	}
+
+	return n, err
+}
+
+func (tr *trackingReader) Close() error {
+	tr.once.Do(func() {
+		tr.r.finish(tr.lp)
+	})
+
+	return tr.ReadCloser.Close()
+}
+
+// logHandler wraps a slog.Handler so that log records are written above the
+// live terminal display.
+type logHandler struct {
+	slog.Handler
+	r *Reporter
+}
+
+func (h *logHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.r.mu.Lock()
+	defer h.r.mu.Unlock()
+
+	h.r.clear()
+	defer h.r.draw()
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithAttrs(attrs), r: h.r}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithGroup(name), r: h.r}
+}
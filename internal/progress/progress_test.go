@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package progress_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/progress"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReporterJSON(t *testing.T) {
+	out, err := os.Create(filepath.Join(t.TempDir(), "progress.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, out.Close())
+	})
+
+	r, err := progress.NewReporter(out, progress.ModeJSON)
+	require.NoError(t, err)
+
+	digest, _, err := v1.SHA256(bytes.NewReader([]byte("layer")))
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("a"), 4096)
+	rc := r.Track("nginx:latest", digest, int64(len(data)), io.NopCloser(bytes.NewReader(data)))
+
+	_, err = io.Copy(io.Discard, rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	_, err = out.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	scanner := bufio.NewScanner(out)
+	require.True(t, scanner.Scan())
+
+	var event progress.Event
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+
+	assert.Equal(t, "nginx:latest", event.Image)
+	assert.Equal(t, digest.String(), event.Layer)
+	assert.Equal(t, int64(len(data)), event.BytesDone)
+	assert.Equal(t, int64(len(data)), event.BytesTotal)
+	assert.True(t, event.Done)
+}
+
+func TestResolveMode(t *testing.T) {
+	out, err := os.Create(filepath.Join(t.TempDir(), "progress.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, out.Close())
+	})
+
+	mode, err := progress.ResolveMode(out, progress.ModeAuto)
+	require.NoError(t, err)
+	assert.Equal(t, progress.ModeJSON, mode)
+
+	mode, err = progress.ResolveMode(out, progress.ModeNone)
+	require.NoError(t, err)
+	assert.Equal(t, progress.ModeNone, mode)
+
+	_, err = progress.ResolveMode(out, "fancy")
+	require.Error(t, err)
+}
+
+func TestNilReporter(t *testing.T) {
+	r, err := progress.NewReporter(os.Stderr, progress.ModeNone)
+	require.NoError(t, err)
+	require.Nil(t, r)
+
+	rc := io.NopCloser(bytes.NewReader(nil))
+	assert.Equal(t, rc, r.Track("nginx:latest", v1.Hash{}, 0, rc))
+}
@@ -0,0 +1,280 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/docker/cli/cli/config"
+	airgapifyv1alpha1 "github.com/dpeckett/airgapify/api/v1alpha1"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Settings holds per-registry connection settings.
+type Settings struct {
+	registries map[string]*registrySettings
+}
+
+type registrySettings struct {
+	insecure  bool
+	transport http.RoundTripper
+	auth      authn.Authenticator
+	keychain  authn.Keychain
+}
+
+// NewSettings loads the connection settings for a set of registries. Any
+// referenced CA bundles, client certificates and credentials are read eagerly
+// so that misconfigurations are reported up front.
+func NewSettings(specs []airgapifyv1alpha1.ConfigRegistrySpec) (*Settings, error) {
+	s := &Settings{
+		registries: make(map[string]*registrySettings),
+	}
+
+	for _, spec := range specs {
+		reg, err := name.NewRegistry(spec.Host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry host %q: %w", spec.Host, err)
+		}
+
+		rs, err := newRegistrySettings(spec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load settings for registry %q: %w", spec.Host, err)
+		}
+
+		s.registries[reg.RegistryStr()] = rs
+	}
+
+	return s, nil
+}
+
+// ParseReference parses an image reference, allowing plain HTTP for registries
+// that have been marked as insecure.
+func (s *Settings) ParseReference(image string) (name.Reference, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	if rs := s.lookup(ref.Context().Registry); rs != nil && rs.insecure {
+		return name.ParseReference(image, name.Insecure)
+	}
+
+	return ref, nil
+}
+
+// RemoteOptions returns the options to use when talking to the given registry.
+func (s *Settings) RemoteOptions(ctx context.Context, reg name.Registry) []remote.Option {
+	options := []remote.Option{
+		remote.WithContext(ctx),
+	}
+
+	rs := s.lookup(reg)
+	if rs == nil {
+		return append(options, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	}
+
+	if rs.transport != nil {
+		options = append(options, remote.WithTransport(rs.transport))
+	}
+
+	if rs.auth != nil {
+		options = append(options, remote.WithAuth(rs.auth))
+	} else {
+		options = append(options, remote.WithAuthFromKeychain(rs.keychain))
+	}
+
+	return options
+}
+
+func (s *Settings) lookup(reg name.Registry) *registrySettings {
+	if s == nil {
+		return nil
+	}
+
+	return s.registries[reg.RegistryStr()]
+}
+
+func newRegistrySettings(spec airgapifyv1alpha1.ConfigRegistrySpec) (*registrySettings, error) {
+	rs := &registrySettings{
+		insecure: spec.Insecure,
+		keychain: authn.DefaultKeychain,
+	}
+
+	if spec.Insecure || spec.CAFile != "" || spec.CertFile != "" || spec.KeyFile != "" {
+		tlsConfig, err := newTLSConfig(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		transport := remote.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		rs.transport = transport
+	}
+
+	if spec.DockerConfig != "" {
+		rs.keychain = &dockerConfigKeychain{dir: spec.DockerConfig}
+	}
+
+	if spec.Auth != nil {
+		auth, err := newAuthenticator(spec.Auth)
+		if err != nil {
+			return nil, err
+		}
+
+		rs.auth = auth
+	}
+
+	return rs, nil
+}
+
+func newTLSConfig(spec airgapifyv1alpha1.ConfigRegistrySpec) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: spec.Insecure,
+	}
+
+	if spec.CAFile != "" {
+		caPEM, err := os.ReadFile(spec.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", spec.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if spec.CertFile != "" || spec.KeyFile != "" {
+		if spec.CertFile == "" || spec.KeyFile == "" {
+			return nil, errors.New("both certFile and keyFile must be specified")
+		}
+
+		cert, err := tls.LoadX509KeyPair(spec.CertFile, spec.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func newAuthenticator(spec *airgapifyv1alpha1.ConfigRegistryAuthSpec) (authn.Authenticator, error) {
+	if spec.Token != nil {
+		token, err := resolveValue(spec.Token)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %w", err)
+		}
+
+		return authn.FromConfig(authn.AuthConfig{RegistryToken: token}), nil
+	}
+
+	username, err := resolveValue(spec.Username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read username: %w", err)
+	}
+
+	password, err := resolveValue(spec.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password: %w", err)
+	}
+
+	return authn.FromConfig(authn.AuthConfig{
+		Username: username,
+		Password: password,
+	}), nil
+}
+
+func resolveValue(src *airgapifyv1alpha1.ConfigValueSource) (string, error) {
+	if src == nil {
+		return "", nil
+	}
+
+	switch {
+	case src.File != "":
+		data, err := os.ReadFile(src.File)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(data)), nil
+	case src.Env != "":
+		value, ok := os.LookupEnv(src.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", src.Env)
+		}
+
+		return value, nil
+	default:
+		return src.Value, nil
+	}
+}
+
+// dockerConfigKeychain resolves credentials from a Docker config.json in an
+// explicit directory.
+type dockerConfigKeychain struct {
+	dir string
+}
+
+func (k *dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	cf, err := config.Load(k.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load docker config: %w", err)
+	}
+
+	for _, key := range []string{target.String(), target.RegistryStr()} {
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+
+		cfg, err := cf.GetAuthConfig(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if cfg.Username != "" || cfg.Password != "" || cfg.Auth != "" || cfg.IdentityToken != "" || cfg.RegistryToken != "" {
+			return authn.FromConfig(authn.AuthConfig{
+				Username:      cfg.Username,
+				Password:      cfg.Password,
+				Auth:          cfg.Auth,
+				IdentityToken: cfg.IdentityToken,
+				RegistryToken: cfg.RegistryToken,
+			}), nil
+		}
+	}
+
+	return authn.Anonymous, nil
+}
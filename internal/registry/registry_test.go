@@ -0,0 +1,329 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	airgapifyv1alpha1 "github.com/dpeckett/airgapify/api/v1alpha1"
+	"github.com/dpeckett/airgapify/internal/registry"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettings(t *testing.T) {
+	passwordPath := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordPath, []byte("secret\n"), 0o600))
+
+	t.Setenv("REGISTRY_USERNAME", "admin")
+
+	s, err := registry.NewSettings([]airgapifyv1alpha1.ConfigRegistrySpec{
+		{
+			Host:     "registry.lab:5000",
+			Insecure: true,
+			Auth: &airgapifyv1alpha1.ConfigRegistryAuthSpec{
+				Username: &airgapifyv1alpha1.ConfigValueSource{Env: "REGISTRY_USERNAME"},
+				Password: &airgapifyv1alpha1.ConfigValueSource{File: passwordPath},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("Insecure", func(t *testing.T) {
+		ref, err := s.ParseReference("registry.lab:5000/library/nginx:latest")
+		require.NoError(t, err)
+
+		assert.Equal(t, "http", ref.Context().Registry.Scheme())
+	})
+
+	t.Run("Secure", func(t *testing.T) {
+		ref, err := s.ParseReference("registry.example.com/library/nginx:latest")
+		require.NoError(t, err)
+
+		assert.Equal(t, "https", ref.Context().Registry.Scheme())
+	})
+
+	t.Run("Missing Environment Variable", func(t *testing.T) {
+		_, err := registry.NewSettings([]airgapifyv1alpha1.ConfigRegistrySpec{
+			{
+				Host: "registry.lab:5000",
+				Auth: &airgapifyv1alpha1.ConfigRegistryAuthSpec{
+					Token: &airgapifyv1alpha1.ConfigValueSource{Env: "AIRGAPIFY_DOES_NOT_EXIST"},
+				},
+			},
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		reg, err := name.NewRegistry("quay.io")
+		require.NoError(t, err)
+
+		assert.NotEmpty(t, s.RemoteOptions(context.Background(), reg))
+	})
+}
+
+func TestRemoteOptions(t *testing.T) {
+	dir := t.TempDir()
+
+	// A CA for client certificates, and a certificate issued by it.
+	clientCA, clientCAKey := newCertificate(t, nil, nil)
+	clientCert, clientKey := newCertificate(t, clientCA, clientCAKey)
+
+	clientCertPath := filepath.Join(dir, "client.crt")
+	clientKeyPath := filepath.Join(dir, "client.key")
+	writeCertificate(t, clientCertPath, clientKeyPath, clientCert, clientKey)
+
+	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+
+	tests := []struct {
+		name string
+		// requireClientCert makes the registry require a client certificate.
+		requireClientCert bool
+		// authorization is the Authorization header the registry requires.
+		authorization string
+		spec          func(host, caPath string) airgapifyv1alpha1.ConfigRegistrySpec
+		wantErr       bool
+	}{
+		{
+			name: "Untrusted",
+			spec: func(host, _ string) airgapifyv1alpha1.ConfigRegistrySpec {
+				return airgapifyv1alpha1.ConfigRegistrySpec{Host: host}
+			},
+			wantErr: true,
+		},
+		{
+			name: "CA File",
+			spec: func(host, caPath string) airgapifyv1alpha1.ConfigRegistrySpec {
+				return airgapifyv1alpha1.ConfigRegistrySpec{Host: host, CAFile: caPath}
+			},
+		},
+		{
+			name: "Insecure",
+			spec: func(host, _ string) airgapifyv1alpha1.ConfigRegistrySpec {
+				return airgapifyv1alpha1.ConfigRegistrySpec{Host: host, Insecure: true}
+			},
+		},
+		{
+			name:              "Client Certificate",
+			requireClientCert: true,
+			spec: func(host, caPath string) airgapifyv1alpha1.ConfigRegistrySpec {
+				return airgapifyv1alpha1.ConfigRegistrySpec{
+					Host:     host,
+					CAFile:   caPath,
+					CertFile: clientCertPath,
+					KeyFile:  clientKeyPath,
+				}
+			},
+		},
+		{
+			name:              "Missing Client Certificate",
+			requireClientCert: true,
+			spec: func(host, caPath string) airgapifyv1alpha1.ConfigRegistrySpec {
+				return airgapifyv1alpha1.ConfigRegistrySpec{Host: host, CAFile: caPath}
+			},
+			wantErr: true,
+		},
+		{
+			name:          "Basic Auth",
+			authorization: basicAuth,
+			spec: func(host, caPath string) airgapifyv1alpha1.ConfigRegistrySpec {
+				return airgapifyv1alpha1.ConfigRegistrySpec{
+					Host:   host,
+					CAFile: caPath,
+					Auth: &airgapifyv1alpha1.ConfigRegistryAuthSpec{
+						Username: &airgapifyv1alpha1.ConfigValueSource{Value: "admin"},
+						Password: &airgapifyv1alpha1.ConfigValueSource{Value: "secret"},
+					},
+				}
+			},
+		},
+		{
+			name:          "Wrong Password",
+			authorization: basicAuth,
+			spec: func(host, caPath string) airgapifyv1alpha1.ConfigRegistrySpec {
+				return airgapifyv1alpha1.ConfigRegistrySpec{
+					Host:   host,
+					CAFile: caPath,
+					Auth: &airgapifyv1alpha1.ConfigRegistryAuthSpec{
+						Username: &airgapifyv1alpha1.ConfigValueSource{Value: "admin"},
+						Password: &airgapifyv1alpha1.ConfigValueSource{Value: "wrong"},
+					},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name:          "Token",
+			authorization: "Bearer s3cr3t",
+			spec: func(host, caPath string) airgapifyv1alpha1.ConfigRegistrySpec {
+				return airgapifyv1alpha1.ConfigRegistrySpec{
+					Host:   host,
+					CAFile: caPath,
+					Auth: &airgapifyv1alpha1.ConfigRegistryAuthSpec{
+						Token: &airgapifyv1alpha1.ConfigValueSource{Value: "s3cr3t"},
+					},
+				}
+			},
+		},
+		{
+			name:          "Docker Config",
+			authorization: basicAuth,
+			spec: func(host, caPath string) airgapifyv1alpha1.ConfigRegistrySpec {
+				dockerConfigDir := t.TempDir()
+				dockerConfig := fmt.Sprintf(`{"auths":{%q:{"auth":%q}}}`, host, base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+				require.NoError(t, os.WriteFile(filepath.Join(dockerConfigDir, "config.json"), []byte(dockerConfig), 0o600))
+
+				return airgapifyv1alpha1.ConfigRegistrySpec{
+					Host:         host,
+					CAFile:       caPath,
+					DockerConfig: dockerConfigDir,
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var authorizations []string
+
+			reg := ggcrregistry.New()
+			s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.authorization != "" {
+					mu.Lock()
+					authorizations = append(authorizations, r.Header.Get("Authorization"))
+					mu.Unlock()
+
+					if r.Header.Get("Authorization") != tt.authorization {
+						w.Header().Set("WWW-Authenticate", `Basic realm="airgapify"`)
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+				}
+
+				reg.ServeHTTP(w, r)
+			}))
+			if tt.requireClientCert {
+				pool := x509.NewCertPool()
+				pool.AddCert(clientCA)
+
+				s.TLS = &tls.Config{
+					ClientAuth: tls.RequireAndVerifyClientCert,
+					ClientCAs:  pool,
+				}
+			}
+			s.StartTLS()
+			t.Cleanup(s.Close)
+
+			u, err := url.Parse(s.URL)
+			require.NoError(t, err)
+
+			caPath := filepath.Join(t.TempDir(), "ca.crt")
+			require.NoError(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}), 0o644))
+
+			settings, err := registry.NewSettings([]airgapifyv1alpha1.ConfigRegistrySpec{tt.spec(u.Host, caPath)})
+			require.NoError(t, err)
+
+			img, err := random.Image(256, 1)
+			require.NoError(t, err)
+
+			ref, err := settings.ParseReference(u.Host + "/test/image:latest")
+			require.NoError(t, err)
+
+			err = remote.Write(ref, img, settings.RemoteOptions(context.Background(), ref.Context().Registry)...)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			if tt.authorization != "" {
+				mu.Lock()
+				defer mu.Unlock()
+
+				// After the initial challenge, every request is authenticated.
+				require.NotEmpty(t, authorizations)
+				assert.Equal(t, tt.authorization, authorizations[len(authorizations)-1])
+			}
+		})
+	}
+}
+
+// newCertificate creates a certificate, issued by the parent (or self-signed
+// CA if parent is nil).
+func newCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "airgapify"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+func writeCertificate(t *testing.T, certPath, keyPath string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o644))
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
@@ -0,0 +1,323 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package server serves the images in an archive over the (read-only) OCI
+// distribution API, so the archive can be used as a registry.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/dpeckett/airgapify/internal/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// repository is a repository served from an archive.
+type repository struct {
+	// registry is the registry the repository's images came from.
+	registry string
+	// tags maps tags to manifest (or index) descriptors.
+	tags map[string]v1.Descriptor
+	// manifests maps digests to the media types of every manifest (and index)
+	// reachable from the repository.
+	manifests map[v1.Hash]types.MediaType
+	// blobs is the set of every blob reachable from the repository.
+	blobs map[v1.Hash]bool
+}
+
+// Server is an http.Handler that implements the read-only parts of the OCI
+// distribution API for an archive.
+type Server struct {
+	archive      *archive.Archive
+	repositories map[string]*repository
+}
+
+// New creates a server for an archive. Images are served under their original
+// repository paths (eg. "library/nginx" for docker.io/library/nginx:1.25), the
+// same as when they are pushed to a registry. As such, an archive containing
+// the same repository path from different registries can't be served.
+func New(a *archive.Archive) (*Server, error) {
+	s := &Server{
+		archive:      a,
+		repositories: make(map[string]*repository),
+	}
+
+	for _, desc := range a.Index().Manifests {
+		refName, ok := desc.Annotations[archive.AnnotationRefName]
+		if !ok {
+			continue
+		}
+
+		ref, err := name.ParseReference(refName)
+		if err != nil {
+			slog.Warn("Skipping image with invalid reference name", "refName", refName, "error", err)
+			continue
+		}
+
+		repoName := ref.Context().RepositoryStr()
+		repo, ok := s.repositories[repoName]
+		if !ok {
+			repo = &repository{
+				registry:  ref.Context().RegistryStr(),
+				tags:      make(map[string]v1.Descriptor),
+				manifests: make(map[v1.Hash]types.MediaType),
+				blobs:     make(map[v1.Hash]bool),
+			}
+			s.repositories[repoName] = repo
+		} else if repo.registry != ref.Context().RegistryStr() {
+			return nil, fmt.Errorf("repository %q contains images from both %s and %s", repoName, repo.registry, ref.Context().RegistryStr())
+		}
+
+		if tag, ok := util.ReferenceTag(ref); ok {
+			repo.tags[tag.TagStr()] = desc
+		}
+
+		err = a.Walk([]v1.Descriptor{desc}, func(desc v1.Descriptor) error {
+			if desc.MediaType.IsIndex() || desc.MediaType.IsImage() {
+				repo.manifests[desc.Digest] = desc.MediaType
+			} else {
+				repo.blobs[desc.Digest] = true
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image %q: %w", refName, err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+		return
+	}
+
+	p := r.URL.Path
+	switch {
+	case p == "/v2" || p == "/v2/":
+		writeJSON(w, r, struct{}{})
+	case p == "/v2/_catalog":
+		s.serveCatalog(w, r)
+	case strings.HasPrefix(p, "/v2/") && strings.HasSuffix(p, "/tags/list"):
+		s.serveTags(w, r, strings.TrimSuffix(strings.TrimPrefix(p, "/v2/"), "/tags/list"))
+	case strings.HasPrefix(p, "/v2/") && strings.Contains(p, "/manifests/"):
+		i := strings.LastIndex(p, "/manifests/")
+		s.serveManifest(w, r, p[len("/v2/"):i], p[i+len("/manifests/"):])
+	case strings.HasPrefix(p, "/v2/") && strings.Contains(p, "/blobs/"):
+		i := strings.LastIndex(p, "/blobs/")
+		s.serveBlob(w, r, p[len("/v2/"):i], p[i+len("/blobs/"):])
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+	}
+}
+
+func (s *Server) serveCatalog(w http.ResponseWriter, r *http.Request) {
+	repos := make([]string, 0, len(s.repositories))
+	for repoName := range s.repositories {
+		repos = append(repos, repoName)
+	}
+
+	repos, ok := paginate(w, r, repos)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, r, struct {
+		Repositories []string `json:"repositories"`
+	}{repos})
+}
+
+func (s *Server) serveTags(w http.ResponseWriter, r *http.Request, repoName string) {
+	repo, ok := s.repositories[repoName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", fmt.Sprintf("repository %q not found", repoName))
+		return
+	}
+
+	tags := make([]string, 0, len(repo.tags))
+	for tag := range repo.tags {
+		tags = append(tags, tag)
+	}
+
+	tags, ok = paginate(w, r, tags)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, r, struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{repoName, tags})
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, repoName, reference string) {
+	repo, ok := s.repositories[repoName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", fmt.Sprintf("repository %q not found", repoName))
+		return
+	}
+
+	var digest v1.Hash
+	var mediaType types.MediaType
+	if desc, ok := repo.tags[reference]; ok {
+		digest, mediaType = desc.Digest, desc.MediaType
+	} else if h, err := v1.NewHash(reference); err == nil {
+		digest = h
+		mediaType, ok = repo.manifests[digest]
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("manifest %q not found", reference))
+			return
+		}
+	} else {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("manifest %q not found", reference))
+		return
+	}
+
+	w.Header().Set("Content-Type", string(mediaType))
+	s.serveContent(w, r, digest, "MANIFEST_UNKNOWN")
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, repoName, reference string) {
+	repo, ok := s.repositories[repoName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", fmt.Sprintf("repository %q not found", repoName))
+		return
+	}
+
+	digest, err := v1.NewHash(reference)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", fmt.Sprintf("invalid digest %q", reference))
+		return
+	}
+
+	// Manifests can also be fetched as blobs.
+	if _, ok := repo.manifests[digest]; !ok && !repo.blobs[digest] {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", fmt.Sprintf("blob %q not found", reference))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	s.serveContent(w, r, digest, "BLOB_UNKNOWN")
+}
+
+// serveContent serves a blob from the archive (with support for HEAD and range
+// requests).
+func (s *Server) serveContent(w http.ResponseWriter, r *http.Request, digest v1.Hash, notFoundCode string) {
+	rs, err := s.archive.BlobReader(digest)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, notFoundCode, fmt.Sprintf("%q not found in archive", digest))
+			return
+		}
+
+		slog.Error("Failed to open blob", "digest", digest, "error", err)
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", "failed to read blob")
+		return
+	}
+	defer rs.Close()
+
+	w.Header().Set("Docker-Content-Digest", digest.String())
+	w.Header().Set("Etag", `"`+digest.String()+`"`)
+
+	http.ServeContent(w, r, "", time.Time{}, rs)
+}
+
+// paginate applies the "n" and "last" query parameters to a (sorted) list,
+// setting the Link header if there are more results.
+func paginate(w http.ResponseWriter, r *http.Request, items []string) ([]string, bool) {
+	sort.Strings(items)
+
+	query := r.URL.Query()
+	if last := query.Get("last"); last != "" {
+		items = items[sort.SearchStrings(items, last):]
+		if len(items) > 0 && items[0] == last {
+			items = items[1:]
+		}
+	}
+
+	if query.Has("n") {
+		n, err := strconv.Atoi(query.Get("n"))
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "PAGINATION_NUMBER_INVALID", "invalid number of results")
+			return nil, false
+		}
+
+		if n < len(items) {
+			items = items[:n]
+
+			if n > 0 {
+				next := *r.URL
+				q := next.Query()
+				q.Set("last", items[n-1])
+				next.RawQuery = q.Encode()
+				w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+			}
+		}
+	}
+
+	return items, true
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(data)
+	}
+}
+
+// writeError writes an error response in the format defined by the OCI
+// distribution spec.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	type registryError struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Errors []registryError `json:"errors"`
+	}{[]registryError{{Code: code, Message: message}}})
+}
@@ -0,0 +1,233 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/dpeckett/airgapify/internal/server"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestServer(t *testing.T) {
+	upstream := httptest.NewServer(registry.New())
+	t.Cleanup(upstream.Close)
+
+	u, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	images := sets.NewString()
+	for _, tag := range []string{"v1", "latest"} {
+		ref, err := name.ParseReference(fmt.Sprintf("%s/test/image:%s", u.Host, tag))
+		require.NoError(t, err)
+
+		require.NoError(t, remote.Write(ref, img))
+
+		images.Insert(ref.String())
+	}
+
+	// Also reference the image by both tag and digest (eg. from a lockfile).
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	images.Insert(fmt.Sprintf("%s/test/image:pinned@%s", u.Host, digest))
+
+	outputPath := filepath.Join(t.TempDir(), "images.tar")
+	require.NoError(t, archive.Create(context.Background(), outputPath, images, archive.CreateOptions{}))
+
+	a, err := archive.Open(outputPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+	})
+
+	srv, err := server.New(a)
+	require.NoError(t, err)
+
+	s := httptest.NewServer(srv)
+	t.Cleanup(s.Close)
+
+	su, err := url.Parse(s.URL)
+	require.NoError(t, err)
+
+	reg, err := name.NewRegistry(su.Host)
+	require.NoError(t, err)
+
+	repo, err := name.NewRepository(su.Host + "/test/image")
+	require.NoError(t, err)
+
+	t.Run("Pull", func(t *testing.T) {
+		pulled, err := remote.Image(repo.Tag("v1"))
+		require.NoError(t, err)
+
+		expected, err := img.Digest()
+		require.NoError(t, err)
+
+		digest, err := pulled.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, expected, digest)
+
+		// Read every layer (which verifies their digests).
+		layers, err := pulled.Layers()
+		require.NoError(t, err)
+
+		for _, layer := range layers {
+			rc, err := layer.Compressed()
+			require.NoError(t, err)
+
+			_, err = io.Copy(io.Discard, rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+		}
+
+		byDigest, err := remote.Head(repo.Digest(expected.String()))
+		require.NoError(t, err)
+		assert.Equal(t, expected, byDigest.Digest)
+	})
+
+	t.Run("Catalog", func(t *testing.T) {
+		repos, err := remote.Catalog(context.Background(), reg)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"test/image"}, repos)
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		tags, err := remote.List(repo)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"latest", "pinned", "v1"}, tags)
+	})
+
+	t.Run("Pull Pinned Tag", func(t *testing.T) {
+		pulled, err := remote.Image(repo.Tag("pinned"))
+		require.NoError(t, err)
+
+		pulledDigest, err := pulled.Digest()
+		require.NoError(t, err)
+
+		assert.Equal(t, digest, pulledDigest)
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		layers, err := img.Layers()
+		require.NoError(t, err)
+
+		digest, err := layers[1].Digest()
+		require.NoError(t, err)
+
+		rc, err := layers[1].Compressed()
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, rc.Close())
+		})
+
+		expected, err := io.ReadAll(rc)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/test/image/blobs/%s", s.URL, digest), nil)
+		require.NoError(t, err)
+		req.Header.Set("Range", "bytes=100-199")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, resp.Body.Close())
+		})
+
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, expected[100:200], body)
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		_, err := remote.Head(repo.Tag("missing"))
+		assert.Error(t, err)
+
+		missing, err := name.ParseReference(su.Host + "/missing:v1")
+		require.NoError(t, err)
+
+		_, err = remote.Head(missing)
+		assert.Error(t, err)
+
+		resp, err := http.Get(fmt.Sprintf("%s/v2/test/image/blobs/%s", s.URL, v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%064d", 0)}))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Read Only", func(t *testing.T) {
+		err := remote.Write(repo.Tag("new"), img)
+		assert.Error(t, err)
+	})
+}
+
+func TestServerRepositoryConflict(t *testing.T) {
+	// The same repository path, on two different registries.
+	images := sets.NewString()
+	for i := 0; i < 2; i++ {
+		upstream := httptest.NewServer(registry.New())
+		t.Cleanup(upstream.Close)
+
+		u, err := url.Parse(upstream.URL)
+		require.NoError(t, err)
+
+		img, err := random.Image(1024, 2)
+		require.NoError(t, err)
+
+		ref, err := name.ParseReference(u.Host + "/test/image:v1")
+		require.NoError(t, err)
+
+		require.NoError(t, remote.Write(ref, img))
+
+		images.Insert(ref.String())
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "images.tar")
+	require.NoError(t, archive.Create(context.Background(), outputPath, images, archive.CreateOptions{}))
+
+	a, err := archive.Open(outputPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+	})
+
+	_, err = server.New(a)
+	require.Error(t, err)
+
+	assert.Contains(t, err.Error(), "test/image")
+}
@@ -525,7 +525,9 @@ func (j *JSONPath) evalFilter(input []reflect.Value, node *FilterNode) ([]reflec
 			case len(lefts) > 1:
 				return input, fmt.Errorf("can only compare one element at a time")
 			}
-			left = lefts[0].Interface()
+			// Compare the values pointed to, rather than the pointers themselves.
+			leftValue, _ := template.Indirect(lefts[0])
+			left = leftValue.Interface()
 
 			rights, err := j.evalList(temp, node.Right)
 			if err != nil {
@@ -537,7 +539,8 @@ func (j *JSONPath) evalFilter(input []reflect.Value, node *FilterNode) ([]reflec
 			case len(rights) > 1:
 				return input, fmt.Errorf("can only compare one element at a time")
 			}
-			right = rights[0].Interface()
+			rightValue, _ := template.Indirect(rights[0])
+			right = rightValue.Interface()
 
 			pass := false
 			switch node.Operator {
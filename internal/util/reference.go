@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ReferenceTag returns the tag of an image reference, if it has one. This
+// includes references by both tag and digest (eg. "nginx:1.25@sha256:..."),
+// which are parsed as digest references (the tag is only kept in the original
+// string).
+func ReferenceTag(ref name.Reference) (name.Tag, bool) {
+	switch ref := ref.(type) {
+	case name.Tag:
+		return ref, true
+	case name.Digest:
+		repoTag, _, ok := strings.Cut(ref.String(), "@")
+		if !ok {
+			return name.Tag{}, false
+		}
+
+		// The tag follows the last colon, unless that's the registry port.
+		i := strings.LastIndex(repoTag, ":")
+		if i < 0 || strings.Contains(repoTag[i:], "/") {
+			return name.Tag{}, false
+		}
+
+		return ref.Context().Tag(repoTag[i+1:]), true
+	default:
+		return name.Tag{}, false
+	}
+}
@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util_test
+
+import (
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferenceTag(t *testing.T) {
+	const digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+	tests := []struct {
+		ref     string
+		wantTag string
+	}{
+		{ref: "nginx:1.25", wantTag: "index.docker.io/library/nginx:1.25"},
+		{ref: "nginx", wantTag: "index.docker.io/library/nginx:latest"},
+		{ref: "nginx:1.25@" + digest, wantTag: "index.docker.io/library/nginx:1.25"},
+		{ref: "registry.lab:5000/team/app:v1@" + digest, wantTag: "registry.lab:5000/team/app:v1"},
+		{ref: "registry.lab:5000/team/app@" + digest},
+		{ref: "nginx@" + digest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			ref, err := name.ParseReference(tt.ref)
+			require.NoError(t, err)
+
+			tag, ok := util.ReferenceTag(ref)
+			if tt.wantTag == "" {
+				assert.False(t, ok)
+				return
+			}
+
+			require.True(t, ok)
+			assert.Equal(t, tt.wantTag, tag.Name())
+		})
+	}
+}
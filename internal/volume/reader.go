@@ -0,0 +1,181 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package volume
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Reader provides random access to an archive that has been split into
+// volumes, without reassembling it.
+type Reader struct {
+	files   []*os.File
+	offsets []int64
+	size    int64
+}
+
+// Open opens the volumes listed in a volume manifest for reading in place.
+// The volume sizes are checked, but their contents are not verified (see Join).
+func Open(manifestPath string) (*Reader, error) {
+	m, err := LoadManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{}
+	for _, vol := range m.Volumes {
+		f, err := os.Open(filepath.Join(filepath.Dir(manifestPath), vol.Name))
+		if err != nil {
+			_ = r.Close()
+			return nil, fmt.Errorf("failed to open volume: %w", err)
+		}
+
+		r.files = append(r.files, f)
+
+		fi, err := f.Stat()
+		if err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+
+		if fi.Size() != vol.Size {
+			_ = r.Close()
+			return nil, fmt.Errorf("volume %q is %d bytes, expected %d", vol.Name, fi.Size(), vol.Size)
+		}
+
+		r.offsets = append(r.offsets, r.size)
+		r.size += vol.Size
+	}
+
+	if r.size != m.Size {
+		_ = r.Close()
+		return nil, fmt.Errorf("volumes total %d bytes, expected %d", r.size, m.Size)
+	}
+
+	return r, nil
+}
+
+// Size returns the total size of the joined archive.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	var read int
+	for len(p) > 0 {
+		if off >= r.size {
+			return read, io.EOF
+		}
+
+		// Find the volume containing the offset.
+		i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+		volEnd := r.size
+		if i+1 < len(r.offsets) {
+			volEnd = r.offsets[i+1]
+		}
+
+		chunk := p[:min(int64(len(p)), volEnd-off)]
+
+		n, err := r.files[i].ReadAt(chunk, off-r.offsets[i])
+		read += n
+		off += int64(n)
+		p = p[n:]
+		if err != nil && !(errors.Is(err, io.EOF) && n == len(chunk)) {
+			return read, err
+		}
+	}
+
+	return read, nil
+}
+
+func (r *Reader) Close() error {
+	var errs []error
+	for _, f := range r.files {
+		errs = append(errs, f.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Join verifies each of the volumes listed in a volume manifest and writes the
+// reassembled archive to dst (which may be io.Discard to only verify).
+func Join(manifestPath string, dst io.Writer) error {
+	m, err := LoadManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	dst = io.MultiWriter(dst, hasher)
+
+	var total int64
+	for _, vol := range m.Volumes {
+		n, err := copyVolume(dst, filepath.Dir(manifestPath), vol)
+		if err != nil {
+			return err
+		}
+
+		total += n
+	}
+
+	if total != m.Size {
+		return fmt.Errorf("archive is %d bytes, expected %d", total, m.Size)
+	}
+
+	if digest := fmt.Sprintf("%x", hasher.Sum(nil)); digest != m.Digest.Hex {
+		return fmt.Errorf("archive digest mismatch: got sha256:%s, expected %s", digest, m.Digest)
+	}
+
+	return nil
+}
+
+// copyVolume copies a single volume to dst, verifying its size and digest.
+func copyVolume(dst io.Writer, dir string, vol Volume) (int64, error) {
+	f, err := os.Open(filepath.Join(dir, vol.Name))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open volume: %w", err)
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, hasher), f)
+	if err != nil {
+		return n, fmt.Errorf("failed to read volume %q: %w", vol.Name, err)
+	}
+
+	if n != vol.Size {
+		return n, fmt.Errorf("volume %q is %d bytes, expected %d", vol.Name, n, vol.Size)
+	}
+
+	if digest := fmt.Sprintf("%x", hasher.Sum(nil)); digest != vol.Digest.Hex {
+		return n, fmt.Errorf("volume %q digest mismatch: got sha256:%s, expected %s", vol.Name, digest, vol.Digest)
+	}
+
+	return n, nil
+}
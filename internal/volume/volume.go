@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package volume
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ManifestSuffix is appended to the archive name to form the name of the
+// volume manifest.
+const ManifestSuffix = ".volumes.json"
+
+// Manifest describes how an archive has been split into volumes.
+type Manifest struct {
+	// Name is the file name of the original (joined) archive.
+	Name string `json:"name"`
+	// Size is the total size of the archive in bytes.
+	Size int64 `json:"size"`
+	// Digest is the digest of the joined archive.
+	Digest v1.Hash `json:"digest"`
+	// Volumes is the ordered list of volumes making up the archive.
+	Volumes []Volume `json:"volumes"`
+}
+
+// Volume is a single fixed-size piece of an archive.
+type Volume struct {
+	// Name is the file name of the volume (relative to the manifest).
+	Name string `json:"name"`
+	// Size is the size of the volume in bytes.
+	Size int64 `json:"size"`
+	// Digest is the digest of the volume.
+	Digest v1.Hash `json:"digest"`
+}
+
+// IsManifest returns true if the path looks like a volume manifest.
+func IsManifest(path string) bool {
+	return strings.HasSuffix(path, ManifestSuffix)
+}
+
+// LoadManifest reads a volume manifest from disk. As the manifest may have
+// come from an untrusted source, the archive and volume names must be plain
+// file names (so they can't refer to files outside the manifest's directory).
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse volume manifest: %w", err)
+	}
+
+	if len(m.Volumes) == 0 {
+		return nil, errors.New("volume manifest does not list any volumes")
+	}
+
+	if !isFileName(m.Name) {
+		return nil, fmt.Errorf("invalid archive name %q in volume manifest", m.Name)
+	}
+
+	for _, vol := range m.Volumes {
+		if !isFileName(vol.Name) {
+			return nil, fmt.Errorf("invalid volume name %q in volume manifest", vol.Name)
+		}
+	}
+
+	return &m, nil
+}
+
+// isFileName returns whether name is a plain file name, without any directory
+// components.
+func isFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// Writer splits a stream into numbered fixed-size volumes (eg. images.tar.001,
+// images.tar.002, ...) and writes a manifest describing them on close.
+type Writer struct {
+	path       string
+	volumeSize int64
+	manifest   Manifest
+	hasher     hash.Hash
+	current    *os.File
+	currentLen int64
+	volHasher  hash.Hash
+}
+
+// NewWriter creates a new volume writer for the archive at path.
+func NewWriter(path string, volumeSize int64) (*Writer, error) {
+	if volumeSize <= 0 {
+		return nil, fmt.Errorf("invalid volume size %d", volumeSize)
+	}
+
+	return &Writer{
+		path:       path,
+		volumeSize: volumeSize,
+		manifest: Manifest{
+			Name: filepath.Base(path),
+		},
+		hasher: sha256.New(),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if w.current == nil || w.currentLen == w.volumeSize {
+			if err := w.nextVolume(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := p[:min(int64(len(p)), w.volumeSize-w.currentLen)]
+
+		n, err := w.current.Write(chunk)
+		w.currentLen += int64(n)
+		w.hasher.Write(chunk[:n])
+		w.volHasher.Write(chunk[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close finishes the last volume and writes the manifest.
+func (w *Writer) Close() error {
+	if w.current == nil {
+		if err := w.nextVolume(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.finishVolume(); err != nil {
+		return err
+	}
+
+	w.manifest.Digest = v1.Hash{
+		Algorithm: "sha256",
+		Hex:       fmt.Sprintf("%x", w.hasher.Sum(nil)),
+	}
+
+	data, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(w.path+ManifestSuffix, data, 0o644)
+}
+
+// Remove deletes any volumes written so far (eg. after a failure).
+func (w *Writer) Remove() error {
+	if w.current != nil {
+		_ = w.current.Close()
+		w.manifest.Volumes = append(w.manifest.Volumes, Volume{Name: filepath.Base(w.current.Name())})
+		w.current = nil
+	}
+
+	var errs []error
+	for _, vol := range w.manifest.Volumes {
+		if err := os.Remove(filepath.Join(filepath.Dir(w.path), vol.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (w *Writer) nextVolume() error {
+	if w.current != nil {
+		if err := w.finishVolume(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(fmt.Sprintf("%s.%03d", w.path, len(w.manifest.Volumes)+1))
+	if err != nil {
+		return fmt.Errorf("failed to create volume: %w", err)
+	}
+
+	w.current = f
+	w.currentLen = 0
+	w.volHasher = sha256.New()
+
+	return nil
+}
+
+func (w *Writer) finishVolume() error {
+	if err := w.current.Close(); err != nil {
+		return fmt.Errorf("failed to close volume: %w", err)
+	}
+
+	w.manifest.Size += w.currentLen
+	w.manifest.Volumes = append(w.manifest.Volumes, Volume{
+		Name: filepath.Base(w.current.Name()),
+		Size: w.currentLen,
+		Digest: v1.Hash{
+			Algorithm: "sha256",
+			Hex:       fmt.Sprintf("%x", w.volHasher.Sum(nil)),
+		},
+	})
+	w.current = nil
+
+	return nil
+}
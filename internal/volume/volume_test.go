@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package volume_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/airgapify/internal/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolumes(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "images.tar")
+
+	data := make([]byte, 10000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	w, err := volume.NewWriter(archivePath, 4096)
+	require.NoError(t, err)
+
+	_, err = io.Copy(w, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	require.NoError(t, w.Close())
+
+	manifestPath := archivePath + volume.ManifestSuffix
+
+	m, err := volume.LoadManifest(manifestPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, "images.tar", m.Name)
+	assert.Equal(t, int64(len(data)), m.Size)
+	require.Len(t, m.Volumes, 3)
+	assert.Equal(t, "images.tar.001", m.Volumes[0].Name)
+	assert.Equal(t, int64(4096), m.Volumes[0].Size)
+	assert.Equal(t, int64(10000-2*4096), m.Volumes[2].Size)
+
+	t.Run("Join", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, volume.Join(manifestPath, &buf))
+
+		assert.Equal(t, data, buf.Bytes())
+	})
+
+	t.Run("Read In Place", func(t *testing.T) {
+		r, err := volume.Open(manifestPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, r.Close())
+		})
+
+		assert.Equal(t, int64(len(data)), r.Size())
+
+		// Read across a volume boundary.
+		buf := make([]byte, 200)
+		_, err = r.ReadAt(buf, 4000)
+		require.NoError(t, err)
+
+		assert.Equal(t, data[4000:4200], buf)
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		volumePath := filepath.Join(filepath.Dir(archivePath), m.Volumes[1].Name)
+
+		corrupted := bytes.Clone(data[4096:8192])
+		corrupted[0] ^= 0xff
+		require.NoError(t, os.WriteFile(volumePath, corrupted, 0o644))
+
+		require.Error(t, volume.Join(manifestPath, io.Discard))
+	})
+
+	t.Run("Path Traversal", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			manifest volume.Manifest
+		}{
+			{
+				name:     "Archive Name",
+				manifest: volume.Manifest{Name: "../../etc/cron.d/x", Volumes: m.Volumes},
+			},
+			{
+				name:     "Volume Name",
+				manifest: volume.Manifest{Name: m.Name, Volumes: []volume.Volume{{Name: "../../etc/passwd"}}},
+			},
+			{
+				name:     "Absolute Volume Name",
+				manifest: volume.Manifest{Name: m.Name, Volumes: []volume.Volume{{Name: "/etc/passwd"}}},
+			},
+			{
+				name:     "Parent Directory",
+				manifest: volume.Manifest{Name: "..", Volumes: m.Volumes},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				manifestPath := filepath.Join(t.TempDir(), "images.tar"+volume.ManifestSuffix)
+
+				data, err := json.Marshal(tt.manifest)
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(manifestPath, data, 0o644))
+
+				_, err = volume.LoadManifest(manifestPath)
+				require.Error(t, err)
+
+				require.Error(t, volume.Join(manifestPath, io.Discard))
+			})
+		}
+	})
+}
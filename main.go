@@ -19,25 +19,50 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	goruntime "runtime"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/dpeckett/airgapify/api/v1alpha1"
 	airgapifyv1alpha1 "github.com/dpeckett/airgapify/api/v1alpha1"
 	"github.com/dpeckett/airgapify/internal/archive"
+	"github.com/dpeckett/airgapify/internal/artifact"
+	"github.com/dpeckett/airgapify/internal/compression"
 	"github.com/dpeckett/airgapify/internal/constants"
 	"github.com/dpeckett/airgapify/internal/extractor"
+	"github.com/dpeckett/airgapify/internal/helm"
 	"github.com/dpeckett/airgapify/internal/loader"
+	"github.com/dpeckett/airgapify/internal/lockfile"
+	"github.com/dpeckett/airgapify/internal/manifests"
+	"github.com/dpeckett/airgapify/internal/mirror"
+	"github.com/dpeckett/airgapify/internal/progress"
+	"github.com/dpeckett/airgapify/internal/registry"
+	"github.com/dpeckett/airgapify/internal/server"
 	"github.com/dpeckett/airgapify/internal/util"
+	"github.com/dpeckett/airgapify/internal/volume"
 	"github.com/dpeckett/telemetry"
 	telemetryv1alpha1 "github.com/dpeckett/telemetry/v1alpha1"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/urfave/cli/v2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
 )
 
 func main() {
@@ -49,14 +74,49 @@ func main() {
 		},
 	}
 
+	var logLevel slog.LevelVar
+
 	initLogger := func(c *cli.Context) error {
+		logLevel.Set(slog.Level(*c.Generic("log-level").(*util.LevelFlag)))
+
 		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level: (*slog.Level)(c.Generic("log-level").(*util.LevelFlag)),
+			Level: &logLevel,
 		})))
 
 		return nil
 	}
 
+	// Subcommands may override the log level set on the root command.
+	initCommandLogger := func(c *cli.Context) error {
+		if !c.IsSet("log-level") {
+			return nil
+		}
+
+		return initLogger(c)
+	}
+
+	// JSON progress events are written to stderr along with the logs, so that
+	// every line is a JSON object, the logs are then written as JSON too.
+	newProgressReporter := func(c *cli.Context) (*progress.Reporter, error) {
+		mode, err := progress.ResolveMode(os.Stderr, progress.Mode(c.String("progress")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create progress reporter: %w", err)
+		}
+
+		if mode == progress.ModeJSON {
+			slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+				Level: &logLevel,
+			})))
+		}
+
+		reporter, err := progress.NewReporter(os.Stderr, mode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create progress reporter: %w", err)
+		}
+
+		return reporter, nil
+	}
+
 	// Collect anonymized usage statistics.
 	var telemetryReporter *telemetry.Reporter
 
@@ -104,68 +164,122 @@ func main() {
 		return nil
 	}
 
+	compressionFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "compression",
+			Usage: "The compression algorithm (gzip, zstd, xz, lz4, none). Defaults to inferring it from the output file extension.",
+		},
+		&cli.IntFlag{
+			Name:  "compression-level",
+			Usage: "The compression level (eg. 1-9 for gzip, 1-22 for zstd). Defaults to the algorithm's default level.",
+		},
+		&cli.IntFlag{
+			Name:  "compression-threads",
+			Usage: "The number of threads to use for compression (gzip, zstd, lz4). Defaults to the number of CPUs.",
+		},
+	}
+
 	app := &cli.App{
 		Name:    "airgapify",
 		Usage:   "A little tool that will construct an OCI image archive from a set of Kubernetes manifests.",
 		Version: constants.Version,
 		Flags: append([]cli.Flag{
 			&cli.StringSliceFlag{
-				Name:     "file",
-				Aliases:  []string{"f"},
-				Usage:    "Path to one or more Kubernetes manifests.",
-				Required: true,
+				Name:    "file",
+				Aliases: []string{"f"},
+				Usage:   "Path to one or more Kubernetes manifests.",
 			},
 			&cli.StringFlag{
 				Name:    "output",
 				Aliases: []string{"o"},
-				Usage:   "Where to write the OCI image archive (optionally compressed).",
+				Usage:   "Where to write the OCI image archive (optionally compressed), or - for stdout.",
 				Value:   "images.tar",
 			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Resolve image manifests and report the estimated archive size, without downloading any layers.",
+			},
+			&cli.StringFlag{
+				Name:  "progress",
+				Usage: "How to report download progress (auto, tty, json, none).",
+				Value: string(progress.ModeAuto),
+			},
+			&cli.StringFlag{
+				Name:  "push",
+				Usage: "Copy the images directly to a registry (optionally with a repository prefix), instead of creating an archive.",
+			},
+			&cli.BoolFlag{
+				Name:  "stream",
+				Usage: "Write blobs directly into the archive as they are fetched, instead of staging them in a temporary directory. On failure, a truncated archive may already have been written to stdout (check the exit status).",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "The output format of the archive (oci, oci-dir, docker-archive, k3s).",
+				Value: string(archive.FormatOCI),
+			},
 			&cli.StringFlag{
 				Name:    "platform",
 				Aliases: []string{"p"},
 				Usage:   "The target platform for the image archive.",
 			},
-		}, persistentFlags...),
+			&cli.StringFlag{
+				Name:  "volume-size",
+				Usage: "Split the archive into numbered volumes of at most this size (eg. 4Gi).",
+			},
+			&cli.BoolFlag{
+				Name:  "embed-manifests",
+				Usage: "Embed the Kubernetes manifests in the archive (see extract-manifests).",
+			},
+			&cli.StringFlag{
+				Name:  "rewrite-manifests",
+				Usage: "Rewrite image references in the embedded manifests to point at this registry (and optional repository prefix).",
+			},
+			&cli.StringFlag{
+				Name:  "base",
+				Usage: "Create an incremental archive, omitting blobs already present in this archive (or its index.json).",
+			},
+			&cli.BoolFlag{
+				Name:  "locked",
+				Usage: "Fetch exactly the digests in the lockfile, failing if any images are missing from it (see lock).",
+			},
+			&cli.StringFlag{
+				Name:  "lockfile",
+				Usage: "The path of the lockfile to use with --locked.",
+				Value: lockfile.DefaultPath,
+			},
+		}, append(compressionFlags, persistentFlags...)...),
 		Before: util.BeforeAll(initLogger, initTelemetry),
 		After:  shutdownTelemetry,
 		Action: func(c *cli.Context) error {
-			objects, err := loader.LoadObjectsFromFiles(c.StringSlice("file"))
-			if err != nil {
-				return fmt.Errorf("failed to load objects: %w", err)
+			// Not marked as required, as that would also require it for the
+			// subcommands.
+			if len(c.StringSlice("file")) == 0 {
+				return errors.New("required flag \"file\" not set")
 			}
 
-			slog.Info("Loaded objects", "count", len(objects))
-
-			rules := extractor.DefaultRules
-
-			for _, obj := range objects {
-				if obj.GetAPIVersion() == v1alpha1.GroupVersion.String() && obj.GetKind() == "Config" {
-					slog.Info("Found airgapify config")
-
-					var config airgapifyv1alpha1.Config
-					err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &config)
-					if err != nil {
-						return fmt.Errorf("failed to convert config: %w", err)
-					}
-
-					for _, rule := range config.Spec.Rules {
-						rules = append(rules, extractor.ImageReferenceExtractionRule{
-							TypeMeta: rule.TypeMeta,
-							Paths:    rule.Paths,
-						})
-					}
+			// Created up front so that, if progress is reported as JSON, all
+			// the log records are too.
+			var reporter *progress.Reporter
+			if !c.Bool("dry-run") {
+				var err error
+				reporter, err = newProgressReporter(c)
+				if err != nil {
+					return err
 				}
 			}
 
-			e := extractor.NewImageReferenceExtractor(rules)
-			images, err := e.ExtractImageReferences(objects)
+			m, err := loadManifests(c.StringSlice("file"))
 			if err != nil {
-				return fmt.Errorf("failed to extract image references: %w", err)
+				return err
 			}
 
-			if images.Len() > 0 {
-				slog.Info("Found image references", "count", images.Len())
+			registrySettings, err := registry.NewSettings(m.config.registries)
+			if err != nil {
+				return fmt.Errorf("failed to load registry settings: %w", err)
+			}
+
+			if m.images.Len() > 0 {
+				slog.Info("Found image references", "count", m.images.Len())
 			}
 
 			var platform *v1.Platform
@@ -177,12 +291,866 @@ func main() {
 			}
 
 			outputPath := c.String("output")
-			if err := archive.Create(c.Context, outputPath, images, platform); err != nil {
+			opts := archive.CreateOptions{
+				Format:     archive.Format(c.String("format")),
+				Platform:   platform,
+				Registries: registrySettings,
+				Base:       c.String("base"),
+				Stream:     c.Bool("stream"),
+			}
+
+			if c.Bool("locked") {
+				lock, err := lockfile.Load(c.String("lockfile"))
+				if err != nil {
+					return err
+				}
+
+				opts.Digests, err = lockfile.Digests(lock, m.images, registrySettings)
+				if err != nil {
+					return err
+				}
+			} else if c.IsSet("lockfile") {
+				return errors.New("--lockfile requires --locked")
+			}
+
+			for _, chart := range m.config.charts {
+				a, err := helm.Artifact(chart.Path, chart.Repository)
+				if err != nil {
+					return fmt.Errorf("failed to package chart %q: %w", chart.Path, err)
+				}
+
+				opts.Artifacts = append(opts.Artifacts, a)
+			}
+
+			for _, spec := range m.config.artifacts {
+				var files []artifact.File
+				for _, f := range spec.Files {
+					files = append(files, artifact.File{
+						Path:      f.Path,
+						MediaType: types.MediaType(f.MediaType),
+					})
+				}
+
+				a, err := artifact.FromFiles(spec.Name, spec.ArtifactType, files, spec.Annotations)
+				if err != nil {
+					return fmt.Errorf("failed to create artifact %q: %w", spec.Name, err)
+				}
+
+				opts.Artifacts = append(opts.Artifacts, a)
+			}
+
+			if c.Bool("embed-manifests") {
+				var rewrite extractor.RewriteFunc
+				if target := c.String("rewrite-manifests"); target != "" {
+					rewrite = manifests.ImageRewriter(registrySettings, target, nil)
+				}
+
+				opts.Manifests, err = manifests.Embed(m.files, m.extractor, rewrite)
+				if err != nil {
+					return fmt.Errorf("failed to embed manifests: %w", err)
+				}
+			} else if c.IsSet("rewrite-manifests") {
+				return errors.New("--rewrite-manifests requires --embed-manifests")
+			}
+
+			opts.Compression, err = compressionOptions(c)
+			if err != nil {
+				return err
+			}
+
+			if c.IsSet("volume-size") {
+				volumeSize, err := resource.ParseQuantity(c.String("volume-size"))
+				if err != nil {
+					return fmt.Errorf("failed to parse volume size: %w", err)
+				}
+
+				opts.VolumeSize = volumeSize.Value()
+			}
+
+			if c.Bool("dry-run") {
+				estimate, err := archive.EstimateSize(c.Context, m.images, opts)
+				if err != nil {
+					return fmt.Errorf("failed to estimate archive size: %w", err)
+				}
+
+				return printEstimate(os.Stdout, estimate, outputPath, opts.Stream)
+			}
+
+			opts.Progress = reporter
+			opts.Progress.Start(c.Context)
+			defer opts.Progress.Stop()
+
+			if c.IsSet("push") {
+				if len(opts.Artifacts) > 0 {
+					slog.Warn("Artifacts are only added to archives, not pushed", "count", len(opts.Artifacts))
+				}
+
+				mappings, err := mirror.Push(c.Context, m.images, c.String("push"), mirror.Options{
+					Platform:   opts.Platform,
+					Registries: opts.Registries,
+					Progress:   opts.Progress,
+					Digests:    opts.Digests,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to push images: %w", err)
+				}
+
+				slog.Info("Pushed images", "count", len(mappings))
+
+				return nil
+			}
+
+			if err := archive.Create(c.Context, outputPath, m.images, opts); err != nil {
 				return fmt.Errorf("failed to create image archive: %w", err)
 			}
 
 			return nil
 		},
+		Commands: []*cli.Command{
+			{
+				Name:      "apply",
+				Usage:     "Apply an incremental archive to the base archive it was created against.",
+				ArgsUsage: "<incremental archive> <base archive>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Where to write the combined archive (defaults to updating the base in place, if it's a directory).",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "The output format of the archive (oci, oci-dir).",
+						Value: string(archive.FormatOCI),
+					},
+				}, append(compressionFlags, persistentFlags...)...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 2 {
+						return errors.New("expected an incremental archive and a base archive argument")
+					}
+
+					compressionOpts, err := compressionOptions(c)
+					if err != nil {
+						return err
+					}
+
+					err = archive.Apply(c.Context, c.Args().Get(0), c.Args().Get(1), c.String("output"), archive.ApplyOptions{
+						Format:      archive.Format(c.String("format")),
+						Compression: compressionOpts,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to apply incremental archive: %w", err)
+					}
+
+					slog.Info("Applied incremental archive")
+
+					return nil
+				},
+			},
+			{
+				Name:      "diff",
+				Usage:     "Show the differences between two archives.",
+				ArgsUsage: "<old archive> <new archive>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "The output format (text, json).",
+						Value:   "text",
+					},
+				}, persistentFlags...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 2 {
+						return errors.New("expected an old and a new archive argument")
+					}
+
+					oldArchive, err := archive.Open(c.Args().Get(0))
+					if err != nil {
+						return fmt.Errorf("failed to open old archive: %w", err)
+					}
+					defer oldArchive.Close()
+
+					newArchive, err := archive.Open(c.Args().Get(1))
+					if err != nil {
+						return fmt.Errorf("failed to open new archive: %w", err)
+					}
+					defer newArchive.Close()
+
+					result, err := archive.Diff(oldArchive, newArchive)
+					if err != nil {
+						return fmt.Errorf("failed to compare archives: %w", err)
+					}
+
+					return printDiff(os.Stdout, result, c.String("output"))
+				},
+			},
+			{
+				Name:      "extract-manifests",
+				Usage:     "Extract the Kubernetes manifests embedded in an archive.",
+				ArgsUsage: "<archive>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "The directory to write the manifests to, or - to write them to stdout as a single stream.",
+						Value:   "manifests",
+					},
+				}, persistentFlags...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("expected a single archive argument")
+					}
+
+					manifests, err := archive.ExtractManifests(c.Args().First())
+					if err != nil {
+						return fmt.Errorf("failed to extract manifests: %w", err)
+					}
+
+					outputDir := c.String("output")
+					if outputDir == "-" {
+						for i, m := range manifests {
+							if i > 0 {
+								fmt.Fprintln(os.Stdout, "---")
+							}
+
+							if _, err := os.Stdout.Write(m.Data); err != nil {
+								return err
+							}
+
+							if !bytes.HasSuffix(m.Data, []byte("\n")) {
+								fmt.Fprintln(os.Stdout)
+							}
+						}
+
+						return nil
+					}
+
+					if err := os.MkdirAll(outputDir, 0o755); err != nil {
+						return fmt.Errorf("failed to create output directory: %w", err)
+					}
+
+					for _, m := range manifests {
+						if err := os.WriteFile(filepath.Join(outputDir, m.Name), m.Data, 0o644); err != nil {
+							return fmt.Errorf("failed to write manifest: %w", err)
+						}
+					}
+
+					slog.Info("Extracted manifests", "count", len(manifests), "path", outputDir)
+
+					return nil
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List the images referenced by a set of Kubernetes manifests, without fetching anything.",
+				Flags: append([]cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "Path to one or more Kubernetes manifests.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "The output format (text, json, yaml).",
+						Value:   "text",
+					},
+					&cli.BoolFlag{
+						Name:  "sources",
+						Usage: "Include the files and objects each image is referenced by.",
+					},
+				}, persistentFlags...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					m, err := loadManifests(c.StringSlice("file"))
+					if err != nil {
+						return err
+					}
+
+					sources := make(map[string][]imageSource)
+					for _, f := range m.files {
+						imageSources, err := m.extractor.ExtractImageSources(f.Objects)
+						if err != nil {
+							return fmt.Errorf("failed to extract image references: %w", err)
+						}
+
+						for image, objects := range imageSources {
+							for _, object := range objects {
+								sources[image] = append(sources[image], imageSource{File: f.Path, ImageSource: object})
+							}
+						}
+					}
+
+					images := make([]listedImage, 0, len(sources))
+					for _, image := range sets.StringKeySet(sources).List() {
+						entry := listedImage{Image: image}
+						if c.Bool("sources") {
+							entry.Sources = sources[image]
+						}
+
+						images = append(images, entry)
+					}
+
+					return printImageList(os.Stdout, images, c.String("output"))
+				},
+			},
+			{
+				Name:      "inspect",
+				Usage:     "List the images and artifacts in an archive.",
+				ArgsUsage: "<archive>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "The output format (table, json).",
+						Value:   "table",
+					},
+				}, persistentFlags...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("expected a single archive argument")
+					}
+
+					a, err := archive.Open(c.Args().First())
+					if err != nil {
+						return fmt.Errorf("failed to open archive: %w", err)
+					}
+					defer a.Close()
+
+					images, err := a.Inspect()
+					if err != nil {
+						return fmt.Errorf("failed to inspect archive: %w", err)
+					}
+
+					return printImageInfo(os.Stdout, images, c.String("output"))
+				},
+			},
+			{
+				Name:  "lock",
+				Usage: "Resolve every image reference in the Kubernetes manifests to a digest, and write them to a lockfile.",
+				Flags: append([]cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "Path to one or more Kubernetes manifests.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Where to write the lockfile, or - for stdout.",
+						Value:   lockfile.DefaultPath,
+					},
+					&cli.BoolFlag{
+						Name:  "check",
+						Usage: "Check the existing lockfile is up to date (instead of writing it), failing if any images have drifted.",
+					},
+					&cli.StringFlag{
+						Name:  "lockfile",
+						Usage: "The path of the lockfile to use with --check.",
+						Value: lockfile.DefaultPath,
+					},
+				}, persistentFlags...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.Bool("check") && c.IsSet("output") {
+						return errors.New("--output cannot be used with --check, use --lockfile instead")
+					} else if !c.Bool("check") && c.IsSet("lockfile") {
+						return errors.New("--lockfile requires --check")
+					}
+
+					m, err := loadManifests(c.StringSlice("file"))
+					if err != nil {
+						return err
+					}
+
+					registrySettings, err := registry.NewSettings(m.config.registries)
+					if err != nil {
+						return fmt.Errorf("failed to load registry settings: %w", err)
+					}
+
+					lock, err := lockfile.Resolve(c.Context, m.images, registrySettings)
+					if err != nil {
+						return fmt.Errorf("failed to resolve images: %w", err)
+					}
+
+					if !c.Bool("check") {
+						if err := lockfile.Write(c.String("output"), lock); err != nil {
+							return err
+						}
+
+						slog.Info("Locked images", "count", len(lock.Spec.Images))
+
+						return nil
+					}
+
+					locked, err := lockfile.Load(c.String("lockfile"))
+					if err != nil {
+						return err
+					}
+
+					drift := lockfile.Compare(locked, lock)
+					if len(drift) == 0 {
+						slog.Info("Lockfile is up to date", "count", len(lock.Spec.Images))
+						return nil
+					}
+
+					if err := printDrift(os.Stdout, drift); err != nil {
+						return err
+					}
+
+					return errors.New("lockfile is out of date")
+				},
+			},
+			{
+				Name:      "merge",
+				Usage:     "Combine several archives into one, deduplicating blobs.",
+				ArgsUsage: "<archive> <archive>...",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "output",
+						Aliases:  []string{"o"},
+						Usage:    "Where to write the combined archive.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "The output format of the archive (oci, oci-dir).",
+						Value: string(archive.FormatOCI),
+					},
+					&cli.StringFlag{
+						Name:  "on-conflict",
+						Usage: "How to resolve images (and embedded manifests) with the same name but different contents (fail, first, last).",
+						Value: string(archive.ConflictFail),
+					},
+				}, append(compressionFlags, persistentFlags...)...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 2 {
+						return errors.New("expected at least two archive arguments")
+					}
+
+					compressionOpts, err := compressionOptions(c)
+					if err != nil {
+						return err
+					}
+
+					conflicts, err := archive.Merge(c.Args().Slice(), c.String("output"), archive.MergeOptions{
+						Format:      archive.Format(c.String("format")),
+						Compression: compressionOpts,
+						Conflicts:   archive.ConflictPolicy(c.String("on-conflict")),
+					})
+					for _, conflict := range conflicts {
+						var digests []string
+						for i, digest := range conflict.Digests {
+							if digest != nil {
+								digests = append(digests, fmt.Sprintf("%s=%s", c.Args().Get(i), digest))
+							}
+						}
+
+						if conflict.Resolved != nil {
+							slog.Warn("Conflicting image", "image", conflict.RefName, "digests", strings.Join(digests, ", "), "resolved", conflict.Resolved.String())
+						} else {
+							slog.Error("Conflicting image", "image", conflict.RefName, "digests", strings.Join(digests, ", "))
+						}
+					}
+					if err != nil {
+						return fmt.Errorf("failed to merge archives: %w", err)
+					}
+
+					slog.Info("Merged archives", "count", c.NArg())
+
+					return nil
+				},
+			},
+			{
+				Name:      "push",
+				Usage:     "Push the images and artifacts in an archive to a registry.",
+				ArgsUsage: "<archive> <registry>",
+				Flags: append([]cli.Flag{
+					&cli.StringSliceFlag{
+						Name:    "file",
+						Aliases: []string{"f"},
+						Usage:   "Path to one or more Kubernetes manifests containing an airgapify config with registry settings.",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "The output format of the image mapping (text, json).",
+						Value:   "text",
+					},
+					&cli.StringFlag{
+						Name:  "progress",
+						Usage: "How to report upload progress (auto, tty, json, none).",
+						Value: string(progress.ModeAuto),
+					},
+				}, persistentFlags...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 2 {
+						return errors.New("expected an archive and a registry argument")
+					}
+
+					reporter, err := newProgressReporter(c)
+					if err != nil {
+						return err
+					}
+
+					var registries []airgapifyv1alpha1.ConfigRegistrySpec
+					if len(c.StringSlice("file")) > 0 {
+						files, err := loader.LoadFiles(c.StringSlice("file"))
+						if err != nil {
+							return fmt.Errorf("failed to load objects: %w", err)
+						}
+
+						config, err := loadConfig(files)
+						if err != nil {
+							return err
+						}
+
+						registries = config.registries
+					}
+
+					registrySettings, err := registry.NewSettings(registries)
+					if err != nil {
+						return fmt.Errorf("failed to load registry settings: %w", err)
+					}
+
+					a, err := archive.Open(c.Args().Get(0))
+					if err != nil {
+						return fmt.Errorf("failed to open archive: %w", err)
+					}
+					defer a.Close()
+
+					reporter.Start(c.Context)
+					defer reporter.Stop()
+
+					mappings, err := mirror.PushArchive(c.Context, a, c.Args().Get(1), mirror.Options{
+						Registries: registrySettings,
+						Progress:   reporter,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to push archive: %w", err)
+					}
+
+					slog.Info("Pushed images", "count", len(mappings))
+
+					return printMappings(os.Stdout, mappings, c.String("output"))
+				},
+			},
+			{
+				Name:      "remove",
+				Aliases:   []string{"prune"},
+				Usage:     "Remove images from an archive, dropping blobs that are no longer referenced.",
+				ArgsUsage: "<archive> <image reference, glob pattern or digest>...",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "output",
+						Aliases:  []string{"o"},
+						Usage:    "Where to write the new archive.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "The output format of the archive (oci, oci-dir).",
+						Value: string(archive.FormatOCI),
+					},
+				}, append(compressionFlags, persistentFlags...)...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 2 {
+						return errors.New("expected an archive and at least one image to remove")
+					}
+
+					compressionOpts, err := compressionOptions(c)
+					if err != nil {
+						return err
+					}
+
+					removed, err := archive.Remove(c.Args().First(), c.String("output"), c.Args().Tail(), archive.RemoveOptions{
+						Format:      archive.Format(c.String("format")),
+						Compression: compressionOpts,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to remove images: %w", err)
+					}
+
+					for _, desc := range removed {
+						slog.Info("Removed image", "image", desc.Annotations[archive.AnnotationRefName], "digest", desc.Digest)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "rewrite",
+				Usage: "Rewrite the image references in Kubernetes manifests to point at an internal registry.",
+				Flags: append([]cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "Path to one or more Kubernetes manifests.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "registry",
+						Usage:    "The registry (and optional repository prefix) the images have been pushed to.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "The directory to write the rewritten manifests to, or - to write them to stdout as a single stream.",
+						Value:   "-",
+					},
+					&cli.BoolFlag{
+						Name:  "in-place",
+						Usage: "Rewrite the manifests in place.",
+					},
+					&cli.BoolFlag{
+						Name:  "pin-digests",
+						Usage: "Pin tagged images to their digests (resolved from the archive, or the registry).",
+					},
+					&cli.StringFlag{
+						Name:  "archive",
+						Usage: "Resolve digests from this archive, instead of the registry.",
+					},
+				}, persistentFlags...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.Bool("in-place") && c.IsSet("output") {
+						return errors.New("--in-place and --output are mutually exclusive")
+					}
+
+					if c.IsSet("archive") && !c.Bool("pin-digests") {
+						return errors.New("--archive requires --pin-digests")
+					}
+
+					m, err := loadManifests(c.StringSlice("file"))
+					if err != nil {
+						return err
+					}
+
+					registrySettings, err := registry.NewSettings(m.config.registries)
+					if err != nil {
+						return fmt.Errorf("failed to load registry settings: %w", err)
+					}
+
+					var resolveDigest manifests.DigestResolver
+					if c.IsSet("archive") {
+						a, err := archive.Open(c.String("archive"))
+						if err != nil {
+							return fmt.Errorf("failed to open archive: %w", err)
+						}
+						defer a.Close()
+
+						resolveDigest = manifests.ArchiveDigests(a)
+					} else if c.Bool("pin-digests") {
+						resolveDigest = manifests.RegistryDigests(c.Context, registrySettings)
+					}
+
+					rewrite := manifests.ImageRewriter(registrySettings, c.String("registry"), resolveDigest)
+
+					return manifests.Rewrite(m.files, m.extractor, rewrite, manifests.RewriteOptions{
+						Output:  c.String("output"),
+						InPlace: c.Bool("in-place"),
+					})
+				},
+			},
+			{
+				Name:      "serve",
+				Usage:     "Serve the images in an archive as a read-only OCI registry.",
+				ArgsUsage: "<archive>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "The address to listen on.",
+						Value: ":5000",
+					},
+					&cli.StringFlag{
+						Name:  "tls-cert",
+						Usage: "Path to a PEM encoded TLS certificate (enables HTTPS).",
+					},
+					&cli.StringFlag{
+						Name:  "tls-key",
+						Usage: "Path to the PEM encoded private key for the TLS certificate.",
+					},
+				}, persistentFlags...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("expected a single archive argument")
+					}
+
+					if c.IsSet("tls-cert") != c.IsSet("tls-key") {
+						return errors.New("--tls-cert and --tls-key must be set together")
+					}
+
+					a, err := archive.Open(c.Args().First())
+					if err != nil {
+						return fmt.Errorf("failed to open archive: %w", err)
+					}
+					defer a.Close()
+
+					handler, err := server.New(a)
+					if err != nil {
+						return fmt.Errorf("failed to load archive: %w", err)
+					}
+
+					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+
+					srv := &http.Server{
+						Addr:              c.String("listen"),
+						Handler:           handler,
+						ReadHeaderTimeout: 30 * time.Second,
+					}
+
+					go func() {
+						<-ctx.Done()
+
+						shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+						defer cancel()
+
+						_ = srv.Shutdown(shutdownCtx)
+					}()
+
+					slog.Info("Serving archive", "address", srv.Addr, "tls", c.IsSet("tls-cert"))
+
+					if c.IsSet("tls-cert") {
+						err = srv.ListenAndServeTLS(c.String("tls-cert"), c.String("tls-key"))
+					} else {
+						err = srv.ListenAndServe()
+					}
+					if err != nil && !errors.Is(err, http.ErrServerClosed) {
+						return fmt.Errorf("failed to serve archive: %w", err)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "verify",
+				Usage:     "Verify the integrity and completeness of an archive.",
+				ArgsUsage: "<archive>",
+				Flags: append([]cli.Flag{
+					&cli.StringSliceFlag{
+						Name:    "file",
+						Aliases: []string{"f"},
+						Usage:   "Also check that the images referenced by these Kubernetes manifests are in the archive.",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "The output format (text, json).",
+						Value:   "text",
+					},
+				}, persistentFlags...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("expected a single archive argument")
+					}
+
+					images := sets.NewString()
+					if len(c.StringSlice("file")) > 0 {
+						m, err := loadManifests(c.StringSlice("file"))
+						if err != nil {
+							return err
+						}
+
+						images = m.images
+					}
+
+					a, err := archive.Open(c.Args().First())
+					if err != nil {
+						return fmt.Errorf("failed to open archive: %w", err)
+					}
+					defer a.Close()
+
+					result, err := a.Verify(images)
+					if err != nil {
+						return fmt.Errorf("failed to verify archive: %w", err)
+					}
+
+					if err := printVerifyResult(os.Stdout, result, c.String("output")); err != nil {
+						return err
+					}
+
+					if !result.OK() {
+						return errors.New("archive verification failed")
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "join",
+				Usage:     "Verify and reassemble an archive that has been split into volumes.",
+				ArgsUsage: "<volume manifest>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Where to write the reassembled archive (defaults to the original archive name).",
+					},
+					&cli.BoolFlag{
+						Name:  "verify-only",
+						Usage: "Only verify the volumes, don't reassemble them.",
+					},
+				}, persistentFlags...),
+				Before: initCommandLogger,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("expected a single volume manifest argument")
+					}
+
+					manifestPath := c.Args().First()
+
+					if c.Bool("verify-only") {
+						if err := volume.Join(manifestPath, io.Discard); err != nil {
+							return fmt.Errorf("failed to verify volumes: %w", err)
+						}
+
+						slog.Info("Volumes verified successfully")
+
+						return nil
+					}
+
+					outputPath := c.String("output")
+					if outputPath == "" {
+						m, err := volume.LoadManifest(manifestPath)
+						if err != nil {
+							return fmt.Errorf("failed to load volume manifest: %w", err)
+						}
+
+						outputPath = filepath.Join(filepath.Dir(manifestPath), m.Name)
+					}
+
+					outputFile, err := os.Create(outputPath)
+					if err != nil {
+						return fmt.Errorf("failed to create output file: %w", err)
+					}
+
+					err = volume.Join(manifestPath, outputFile)
+					if closeErr := outputFile.Close(); err == nil {
+						err = closeErr
+					}
+					if err != nil {
+						_ = os.Remove(outputPath)
+						return fmt.Errorf("failed to join volumes: %w", err)
+					}
+
+					slog.Info("Reassembled archive", "path", outputPath)
+
+					return nil
+				},
+			},
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -190,3 +1158,415 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// printEstimate writes a human readable report of the estimated archive size,
+// and whether there is sufficient free space to create it.
+func printEstimate(w io.Writer, estimate *archive.Estimate, outputPath string, stream bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tDIGEST\tLAYERS\tSHARED\tSIZE")
+	for _, img := range estimate.Images {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", img.Image, img.Digest, img.Layers, img.SharedLayers, util.FormatBytes(img.Size))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nUnique layers: %d (%d shared between images)\n", estimate.UniqueLayers, estimate.SharedLayers)
+	if estimate.ArtifactsSize > 0 {
+		fmt.Fprintf(w, "Artifacts and manifests: %s\n", util.FormatBytes(estimate.ArtifactsSize))
+	}
+	fmt.Fprintf(w, "Total archive size: %s\n", util.FormatBytes(estimate.TotalSize))
+
+	if outputPath == "-" {
+		return nil
+	}
+
+	// Staged archives need room for the temporary layout as well as the output,
+	// which is twice the archive size if they're on the same filesystem.
+	dirs := []string{filepath.Dir(outputPath)}
+	if !stream {
+		dirs = append(dirs, os.TempDir())
+	}
+
+	var filesystems []string
+	dirsByFilesystem := make(map[string][]string)
+	for _, dir := range dirs {
+		id, err := util.FilesystemID(dir)
+		if err != nil {
+			return fmt.Errorf("failed to determine filesystem of %q: %w", dir, err)
+		}
+
+		if _, ok := dirsByFilesystem[id]; !ok {
+			filesystems = append(filesystems, id)
+		}
+		dirsByFilesystem[id] = append(dirsByFilesystem[id], dir)
+	}
+
+	for _, id := range filesystems {
+		fsDirs := dirsByFilesystem[id]
+
+		free, err := util.FreeSpace(fsDirs[0])
+		if err != nil {
+			return fmt.Errorf("failed to determine free space at %q: %w", fsDirs[0], err)
+		}
+
+		required := estimate.TotalSize * int64(len(fsDirs))
+
+		status := "sufficient"
+		if free < uint64(required) {
+			status = "insufficient"
+		}
+
+		fmt.Fprintf(w, "Free space at %s: %s (%s required, %s)\n", strings.Join(fsDirs, " and "), util.FormatBytes(int64(free)), util.FormatBytes(required), status)
+	}
+
+	return nil
+}
+
+// listedImage is an image in the output of the list command.
+type listedImage struct {
+	Image   string        `json:"image"`
+	Sources []imageSource `json:"sources,omitempty"`
+}
+
+// imageSource is an object (and the file it was found in) that references an image.
+type imageSource struct {
+	File string `json:"file"`
+	extractor.ImageSource
+}
+
+// printImageList writes a list of images in the given output format.
+func printImageList(w io.Writer, images []listedImage, format string) error {
+	switch format {
+	case "text":
+		for _, img := range images {
+			fmt.Fprintln(w, img.Image)
+			for _, src := range img.Sources {
+				name := src.Name
+				if src.Namespace != "" {
+					name = src.Namespace + "/" + name
+				}
+
+				fmt.Fprintf(w, "  %s: %s/%s %s\n", src.File, src.APIVersion, src.Kind, name)
+			}
+		}
+
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(images)
+	case "yaml":
+		data, err := yaml.Marshal(images)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		return err
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+// printImageInfo writes a description of the images in an archive in the
+// given output format.
+func printImageInfo(w io.Writer, images []archive.ImageInfo, format string) error {
+	switch format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tDIGEST\tTYPE\tPLATFORMS\tLAYERS\tSIZE")
+		for _, img := range images {
+			mediaType := string(img.MediaType)
+			if img.ArtifactType != "" {
+				mediaType = img.ArtifactType
+			}
+
+			platforms := strings.Join(img.Platforms, ",")
+			if platforms == "" {
+				platforms = "-"
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", img.RefName, img.Digest, mediaType, platforms, img.Layers, util.FormatBytes(img.Size))
+		}
+
+		return tw.Flush()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(images)
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+// printDiff writes the differences between two archives in the given output
+// format.
+func printDiff(w io.Writer, result *archive.DiffResult, format string) error {
+	switch format {
+	case "text":
+		for _, img := range result.Added {
+			fmt.Fprintf(w, "+ %s (%s)\n", img.RefName, img.Digest)
+		}
+
+		for _, img := range result.Removed {
+			fmt.Fprintf(w, "- %s (%s)\n", img.RefName, img.Digest)
+		}
+
+		for _, img := range result.Retagged {
+			fmt.Fprintf(w, "~ %s (%s, previously %s)\n", img.RefName, img.Digest, strings.Join(img.PreviousRefNames, ", "))
+		}
+
+		for _, change := range result.Changed {
+			fmt.Fprintf(w, "* %s (%s -> %s)\n", change.RefName, change.OldDigest, change.NewDigest)
+		}
+
+		fmt.Fprintf(w, "\n%d added, %d removed, %d retagged, %d changed\n",
+			len(result.Added), len(result.Removed), len(result.Retagged), len(result.Changed))
+		fmt.Fprintf(w, "New blobs: %d (%s)\n", result.NewBlobs, util.FormatBytes(result.NewBytes))
+
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+// printMappings writes a mapping of original to new image references in the
+// given output format.
+func printMappings(w io.Writer, mappings []mirror.Mapping, format string) error {
+	switch format {
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "SOURCE\tDESTINATION")
+		for _, m := range mappings {
+			fmt.Fprintf(tw, "%s\t%s\n", m.Source, m.Destination)
+		}
+
+		return tw.Flush()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(mappings)
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+// printVerifyResult writes the result of verifying an archive in the given
+// output format.
+func printVerifyResult(w io.Writer, result *archive.VerifyResult, format string) error {
+	switch format {
+	case "text":
+		for _, p := range result.Corrupt {
+			fmt.Fprintf(w, "corrupt: %s: %s\n", p.Digest, p.Reason)
+		}
+
+		for _, p := range result.Missing {
+			if p.RefName != "" {
+				fmt.Fprintf(w, "missing: %s (referenced by %s)\n", p.Digest, p.RefName)
+			} else {
+				fmt.Fprintf(w, "missing: %s\n", p.Digest)
+			}
+		}
+
+		for _, digest := range result.Orphaned {
+			fmt.Fprintf(w, "orphaned: %s\n", digest)
+		}
+
+		for _, image := range result.MissingImages {
+			fmt.Fprintf(w, "missing image: %s\n", image)
+		}
+
+		status := "OK"
+		if !result.OK() {
+			status = "FAILED"
+		}
+
+		fmt.Fprintf(w, "Verified %d blobs: %d corrupt, %d missing, %d orphaned, %d missing images (%s)\n",
+			result.Blobs, len(result.Corrupt), len(result.Missing), len(result.Orphaned), len(result.MissingImages), status)
+
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+// compressionOptions returns the compression options set on the command line,
+// or nil if the compression should be inferred from the output file extension.
+func compressionOptions(c *cli.Context) (*compression.Options, error) {
+	if !c.IsSet("compression") && !c.IsSet("compression-level") && !c.IsSet("compression-threads") {
+		return nil, nil
+	}
+
+	algorithm := compression.FromFilename(c.String("output"))
+	if c.IsSet("compression") {
+		var err error
+		algorithm, err = compression.ParseAlgorithm(c.String("compression"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opts := &compression.Options{
+		Algorithm: algorithm,
+		Level:     c.Int("compression-level"),
+		Threads:   c.Int("compression-threads"),
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid compression options: %w", err)
+	}
+
+	return opts, nil
+}
+
+// printDrift prints the images whose digests differ from the lockfile.
+func printDrift(out io.Writer, drift []lockfile.Drift) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tLOCKED\tCURRENT")
+	for _, d := range drift {
+		locked, current := d.Locked, d.Current
+		if locked == "" {
+			locked = "-"
+		}
+		if current == "" {
+			current = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n", d.Image, locked, current)
+	}
+
+	return w.Flush()
+}
+
+// inputManifests are the Kubernetes manifests given on the command line, with
+// the configuration and image references found in them.
+type inputManifests struct {
+	files     []loader.File
+	config    *inputConfig
+	extractor *extractor.ImageReferenceExtractor
+	images    sets.String
+}
+
+// loadManifests loads the Kubernetes manifests at the given paths, and
+// extracts their image references (using the rules in any airgapify config).
+func loadManifests(filePaths []string) (*inputManifests, error) {
+	files, err := loader.LoadFiles(filePaths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load objects: %w", err)
+	}
+
+	var objects []unstructured.Unstructured
+	for _, f := range files {
+		objects = append(objects, f.Objects...)
+	}
+
+	slog.Info("Loaded objects", "count", len(objects))
+
+	config, err := loadConfig(files)
+	if err != nil {
+		return nil, err
+	}
+
+	e := extractor.NewImageReferenceExtractor(config.rules)
+	images, err := e.ExtractImageReferences(objects)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract image references: %w", err)
+	}
+
+	return &inputManifests{
+		files:     files,
+		config:    config,
+		extractor: e,
+		images:    images,
+	}, nil
+}
+
+// inputConfig is the combined configuration from the airgapify Config
+// resources found in the manifests.
+type inputConfig struct {
+	rules      []extractor.ImageReferenceExtractionRule
+	registries []airgapifyv1alpha1.ConfigRegistrySpec
+	charts     []airgapifyv1alpha1.ConfigChartSpec
+	artifacts  []airgapifyv1alpha1.ConfigArtifactSpec
+}
+
+// loadConfig combines the airgapify Config resources found in the manifests
+// (with any paths resolved relative to the file they were found in).
+func loadConfig(files []loader.File) (*inputConfig, error) {
+	config := &inputConfig{
+		rules: extractor.DefaultRules,
+	}
+
+	for _, f := range files {
+		for _, obj := range f.Objects {
+			if obj.GetAPIVersion() != v1alpha1.GroupVersion.String() || obj.GetKind() != "Config" {
+				continue
+			}
+
+			slog.Info("Found airgapify config")
+
+			var c airgapifyv1alpha1.Config
+			err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &c)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert config: %w", err)
+			}
+
+			for _, rule := range c.Spec.Rules {
+				config.rules = append(config.rules, extractor.ImageReferenceExtractionRule{
+					TypeMeta: rule.TypeMeta,
+					Paths:    rule.Paths,
+				})
+			}
+
+			for _, r := range c.Spec.Registries {
+				r.CAFile = resolveConfigPath(f.Path, r.CAFile)
+				r.CertFile = resolveConfigPath(f.Path, r.CertFile)
+				r.KeyFile = resolveConfigPath(f.Path, r.KeyFile)
+				r.DockerConfig = resolveConfigPath(f.Path, r.DockerConfig)
+
+				if r.Auth != nil {
+					for _, src := range []*airgapifyv1alpha1.ConfigValueSource{r.Auth.Username, r.Auth.Password, r.Auth.Token} {
+						if src != nil {
+							src.File = resolveConfigPath(f.Path, src.File)
+						}
+					}
+				}
+
+				config.registries = append(config.registries, r)
+			}
+
+			for _, chart := range c.Spec.Charts {
+				chart.Path = resolveConfigPath(f.Path, chart.Path)
+				config.charts = append(config.charts, chart)
+			}
+
+			for _, a := range c.Spec.Artifacts {
+				for i := range a.Files {
+					a.Files[i].Path = resolveConfigPath(f.Path, a.Files[i].Path)
+				}
+				config.artifacts = append(config.artifacts, a)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// resolveConfigPath resolves a path in a config file relative to the directory
+// containing the config file.
+func resolveConfigPath(configPath, path string) string {
+	if path == "" || filepath.IsAbs(path) || configPath == "-" {
+		return path
+	}
+
+	return filepath.Join(filepath.Dir(configPath), path)
+}